@@ -0,0 +1,37 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/digitalocean/godo"
+	"github.com/tam7t/droplan/internal/ctxrun"
+)
+
+// listPage lists a page of the DigitalOcean API until the context is done.
+// godo does not accept a context, so a request which is still running is left
+// to finish in the background, bounded by its client's timeout.
+func listPage[T any](ctx context.Context, request func() (T, *godo.Response, error)) (T, *godo.Response, error) {
+	type page struct {
+		items T
+		resp  *godo.Response
+	}
+	p, err := ctxrun.Run(ctx, func() (page, error) {
+		items, resp, err := request()
+		return page{items, resp}, err
+	})
+	return p.items, p.resp, err
+}
+
+// contextService is implemented by the retrying services, returning a copy
+// which stops waiting to retry a request once the context is done
+type contextService[S any] interface {
+	withContext(context.Context) S
+}
+
+// serviceContext returns the service bound to the context when it supports one
+func serviceContext[S any](ctx context.Context, s S) S {
+	if c, ok := any(s).(contextService[S]); ok {
+		return c.withContext(ctx)
+	}
+	return s
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-metadata"
+	"github.com/digitalocean/godo"
+)
+
+func TestDropletListContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     context.Context
+		list    func(context.CancelFunc) ([]godo.Droplet, *godo.Response, error)
+		expErr  error
+	}{
+		{
+			name:    "context already done",
+			ctx:     canceled,
+			timeout: time.Minute,
+			list: func(context.CancelFunc) ([]godo.Droplet, *godo.Response, error) {
+				return []godo.Droplet{{ID: 1}}, &godo.Response{}, nil
+			},
+			expErr: context.Canceled,
+		},
+		{
+			name:    "request outlives the context",
+			ctx:     context.Background(),
+			timeout: time.Millisecond,
+			list: func(context.CancelFunc) ([]godo.Droplet, *godo.Response, error) {
+				<-block
+				return []godo.Droplet{{ID: 1}}, &godo.Response{}, nil
+			},
+			expErr: context.DeadlineExceeded,
+		},
+		{
+			name:    "context done between pages",
+			ctx:     context.Background(),
+			timeout: time.Minute,
+			list: func(cancel context.CancelFunc) ([]godo.Droplet, *godo.Response, error) {
+				// the first page cancels the context before the second is listed
+				cancel()
+				resp := &godo.Response{Links: &godo.Links{Pages: &godo.Pages{Next: "http://example.com/droplets?page=2", Last: "http://example.com/droplets?page=2"}}}
+				return []godo.Droplet{{ID: 1}}, resp, nil
+			},
+			expErr: context.Canceled,
+		},
+	}
+
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(test.ctx, test.timeout)
+		out, err := DropletList(ctx, &stubDropletService{
+			list: func(*godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+				return test.list(cancel)
+			},
+		})
+		cancel()
+		if out != nil || !errors.Is(err, test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v %v", out, err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestDropletMetadata(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	base, _ := url.Parse(srv.URL)
+	meta := metadata.NewClient(metadata.WithBaseURL(base))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	_, err := DropletMetadata(ctx, meta)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Logf("want:%v", context.DeadlineExceeded)
+		t.Logf("got:%v", err)
+		t.Fatal("unexpected metadata error")
+	}
+
+	_, err = DropletRegion(ctx, meta)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Logf("want:%v", context.DeadlineExceeded)
+		t.Logf("got:%v", err)
+		t.Fatal("unexpected region error")
+	}
+}
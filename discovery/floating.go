@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+// FloatingIPList paginates through the digitalocean API to return a list of
+// all floating IPs, stopping once the context is done
+func FloatingIPList(ctx context.Context, fs godo.FloatingIPsService) ([]godo.FloatingIP, error) {
+	list := []godo.FloatingIP{}
+
+	fs = serviceContext(ctx, fs)
+	opt := &godo.ListOptions{}
+	for {
+		ips, resp, err := listPage(ctx, func() ([]godo.FloatingIP, *godo.Response, error) {
+			return fs.List(opt)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, ips...)
+
+		// if we are at the last page, break out the for loop
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+
+		// set the page we want for the next request
+		opt.Page = page + 1
+	}
+
+	return list, nil
+}
+
+// PublicFloatingIPs returns the floating IPs assigned to the provided droplets
+func PublicFloatingIPs(droplets []godo.Droplet, ips []godo.FloatingIP) []string {
+	ids := map[int]bool{}
+	for _, droplet := range droplets {
+		ids[droplet.ID] = true
+	}
+
+	addrs := []string{}
+	for _, ip := range ips {
+		if ip.Droplet != nil && ids[ip.Droplet.ID] {
+			addrs = append(addrs, ip.IP)
+		}
+	}
+	return addrs
+}
+
+// retryingFloatingIPs retries the floating IP requests droplan makes
+type retryingFloatingIPs struct {
+	godo.FloatingIPsService
+	retrier
+}
+
+// RetryFloatingIPs wraps fs to retry the List requests droplan makes within
+// the budget, logging each retry to logger
+func RetryFloatingIPs(fs godo.FloatingIPsService, budget time.Duration, logger *slog.Logger) godo.FloatingIPsService {
+	return newRetryingFloatingIPs(fs, budget, logger)
+}
+
+func newRetryingFloatingIPs(fs godo.FloatingIPsService, budget time.Duration, logger *slog.Logger) *retryingFloatingIPs {
+	return &retryingFloatingIPs{FloatingIPsService: fs, retrier: newRetrier(budget, logger)}
+}
+
+func (f *retryingFloatingIPs) withContext(ctx context.Context) godo.FloatingIPsService {
+	c := *f
+	c.ctx = ctx
+	return &c
+}
+
+func (f *retryingFloatingIPs) List(opt *godo.ListOptions) ([]godo.FloatingIP, *godo.Response, error) {
+	return retry(&f.retrier, func() ([]godo.FloatingIP, *godo.Response, error) {
+		return f.FloatingIPsService.List(opt)
+	})
+}
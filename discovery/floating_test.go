@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestFloatingIPList(t *testing.T) {
+	fs := &stubFloatingIPService{
+		list: func(opt *godo.ListOptions) ([]godo.FloatingIP, *godo.Response, error) {
+			resp := &godo.Response{}
+			if opt.Page == 0 {
+				resp.Links = &godo.Links{Pages: &godo.Pages{Next: "http://example.com/floating_ips?page=2", Last: "http://example.com/floating_ips?page=2"}}
+				return []godo.FloatingIP{{IP: "198.51.100.1"}}, resp, nil
+			}
+			resp.Links = &godo.Links{Pages: &godo.Pages{Prev: "http://example.com/floating_ips?page=1"}}
+			return []godo.FloatingIP{{IP: "198.51.100.2"}}, resp, nil
+		},
+	}
+
+	exp := []godo.FloatingIP{{IP: "198.51.100.1"}, {IP: "198.51.100.2"}}
+	out, err := FloatingIPList(context.Background(), fs)
+	if err != nil || !reflect.DeepEqual(out, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v %v", out, err)
+		t.Fatal("unexpected floating ips")
+	}
+}
+
+func TestPublicFloatingIPs(t *testing.T) {
+	drops := []godo.Droplet{{ID: 1}, {ID: 2}}
+	ips := []godo.FloatingIP{
+		{IP: "198.51.100.1", Droplet: &godo.Droplet{ID: 1}},
+		{IP: "198.51.100.3", Droplet: &godo.Droplet{ID: 3}},
+		{IP: "198.51.100.4"},
+	}
+
+	exp := []string{"198.51.100.1"}
+	out := PublicFloatingIPs(drops, ips)
+	if !reflect.DeepEqual(out, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out)
+		t.Fatal("unexpected public floating ips")
+	}
+}
+
+type stubFloatingIPService struct {
+	godo.FloatingIPsService
+	list func(*godo.ListOptions) ([]godo.FloatingIP, *godo.Response, error)
+}
+
+func (s *stubFloatingIPService) List(opt *godo.ListOptions) ([]godo.FloatingIP, *godo.Response, error) {
+	return s.list(opt)
+}
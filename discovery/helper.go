@@ -0,0 +1,266 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/digitalocean/go-metadata"
+	"github.com/tam7t/droplan/internal/ctxrun"
+)
+
+// DropletMetadata returns the droplet's metadata from the metadata service,
+// unless the context is done first. The metadata client does not accept a
+// context, so a lookup which is still running is left to finish in the
+// background, bounded by its client's timeout.
+func DropletMetadata(ctx context.Context, meta *metadata.Client) (*metadata.Metadata, error) {
+	return ctxrun.Run(ctx, meta.Metadata)
+}
+
+// DropletRegion returns the droplet's region from the metadata service, unless
+// the context is done first
+func DropletRegion(ctx context.Context, meta *metadata.Client) (string, error) {
+	return ctxrun.Run(ctx, meta.Region)
+}
+
+// Interface is a local network interface and the addresses assigned to it
+type Interface struct {
+	Name  string
+	MAC   string
+	Addrs []net.IP
+}
+
+func (i Interface) String() string {
+	addrs := []string{}
+	for _, addr := range i.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	if i.MAC == "" {
+		return fmt.Sprintf("%s [%s]", i.Name, strings.Join(addrs, " "))
+	}
+	return fmt.Sprintf("%s %s [%s]", i.Name, i.MAC, strings.Join(addrs, " "))
+}
+
+// LocalInterfaces returns the network interfaces of the droplet
+func LocalInterfaces() ([]Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	locals := []Interface{}
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		local := Interface{Name: i.Name, MAC: i.HardwareAddr.String()}
+		for _, addr := range addrs {
+			switch v := addr.(type) {
+			case *net.IPAddr:
+				local.Addrs = append(local.Addrs, v.IP)
+			case *net.IPNet:
+				local.Addrs = append(local.Addrs, v.IP)
+			}
+		}
+		locals = append(locals, local)
+	}
+	return locals, nil
+}
+
+// InterfaceError is returned when none of the local interfaces has the MAC or
+// address listed in metadata
+type InterfaceError struct {
+	MAC        string
+	Address    string
+	Candidates []Interface
+}
+
+func (e *InterfaceError) Error() string {
+	candidates := []string{}
+	for _, c := range e.Candidates {
+		candidates = append(candidates, c.String())
+	}
+	want := fmt.Sprintf("address %s", e.Address)
+	if e.MAC != "" {
+		want = fmt.Sprintf("mac %s or address %s", e.MAC, e.Address)
+	}
+	return fmt.Sprintf("no interface with %s, inspected: %s", want, strings.Join(candidates, ", "))
+}
+
+func (e *InterfaceError) Unwrap() error {
+	return ErrInterfaceNotFound
+}
+
+// FindInterface returns the name of the local interface with the MAC address
+// listed in metadata, falling back to the interface with the local address
+// when no MAC is listed or matched. When several interfaces share the MAC, such
+// as a bond and its slaves, the one with the local address is preferred.
+func FindInterface(ifaces []Interface, mac, local string) (string, error) {
+	// metadata may list ipv6 addresses in their expanded form, so compare
+	// parsed addresses when possible
+	localIP := net.ParseIP(local)
+	hasLocal := func(i Interface) bool {
+		for _, ip := range i.Addrs {
+			if ip.String() == local || (localIP != nil && localIP.Equal(ip)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if hw, err := net.ParseMAC(mac); err == nil {
+		matched := []Interface{}
+		for _, i := range ifaces {
+			if i.MAC == hw.String() {
+				matched = append(matched, i)
+			}
+		}
+		for _, i := range matched {
+			if hasLocal(i) {
+				return i.Name, nil
+			}
+		}
+		if len(matched) > 0 {
+			return matched[0].Name, nil
+		}
+	}
+
+	for _, i := range ifaces {
+		if hasLocal(i) {
+			return i.Name, nil
+		}
+	}
+
+	return "", &InterfaceError{MAC: mac, Address: local, Candidates: ifaces}
+}
+
+// PrivateMAC parses metadata to find the MAC address of the local private
+// interface, which is empty when it is not listed
+func PrivateMAC(data *metadata.Metadata) string {
+	return interfaceMAC(data, "private")
+}
+
+// PublicMAC parses metadata to find the MAC address of the local public
+// interface, which is empty when it is not listed
+func PublicMAC(data *metadata.Metadata) string {
+	return interfaceMAC(data, "public")
+}
+
+func interfaceMAC(data *metadata.Metadata, kind string) string {
+	ifaces := data.Interfaces[kind]
+	if len(ifaces) >= 1 {
+		return ifaces[0].MACAddress
+	}
+	return ""
+}
+
+var (
+	// ErrNoPrivateInterface is returned when metadata lists no private
+	// interface
+	ErrNoPrivateInterface = errors.New("no private interfaces")
+	// ErrNoPublicInterface is returned when metadata lists no public interface
+	ErrNoPublicInterface = errors.New("no public interfaces")
+	// ErrNoIPv4 is returned when an interface listed in metadata has no ipv4
+	// address
+	ErrNoIPv4 = errors.New("no ipv4 address")
+	// ErrNoIPv6 is returned when an interface listed in metadata has no ipv6
+	// address
+	ErrNoIPv6 = errors.New("no ipv6 address")
+	// ErrInterfaceNotFound is wrapped by the InterfaceError returned when no
+	// local interface matches metadata
+	ErrInterfaceNotFound = errors.New("interface not found")
+)
+
+// PrivateAddress parses metadata to find the local private ipv4 interface
+// address
+func PrivateAddress(data *metadata.Metadata) (string, error) {
+	privateIface := data.Interfaces["private"]
+	if len(privateIface) >= 1 {
+		ipV4 := privateIface[0].IPv4
+		if ipV4 == nil {
+			return "", fmt.Errorf("private interface: %w", ErrNoIPv4)
+		}
+
+		return ipV4.IPAddress, nil
+	}
+	return "", ErrNoPrivateInterface
+}
+
+// PublicAddress parses metadata to find the local public ipv4 interface
+// address
+func PublicAddress(data *metadata.Metadata) (string, error) {
+	publicIface := data.Interfaces["public"]
+	if len(publicIface) >= 1 {
+		ipV4 := publicIface[0].IPv4
+		if ipV4 == nil {
+			return "", fmt.Errorf("public interface: %w", ErrNoIPv4)
+		}
+
+		return ipV4.IPAddress, nil
+	}
+	return "", ErrNoPublicInterface
+}
+
+// AnchorAddress parses metadata to find the local anchor ipv4 address of the
+// public interface
+func AnchorAddress(data *metadata.Metadata) (string, error) {
+	publicIface := data.Interfaces["public"]
+	if len(publicIface) >= 1 {
+		anchor := publicIface[0].AnchorIPv4
+		if anchor == nil {
+			return "", fmt.Errorf("public interface anchor: %w", ErrNoIPv4)
+		}
+
+		return anchor.IPAddress, nil
+	}
+	return "", ErrNoPublicInterface
+}
+
+// FloatingAddress parses metadata to find the floating ipv4 address assigned
+// to the droplet. Traffic to it arrives on the anchor address of the public
+// interface.
+func FloatingAddress(data *metadata.Metadata) (string, error) {
+	floating := data.FloatingIP.IPv4
+	if !floating.Active || floating.IPAddress == "" {
+		return "", errors.New("no active floating ip")
+	}
+	return floating.IPAddress, nil
+}
+
+// PublicAddressV6 parses metadata to find the local public ipv6 interface
+// address
+func PublicAddressV6(data *metadata.Metadata) (string, error) {
+	publicIface := data.Interfaces["public"]
+	if len(publicIface) >= 1 {
+		ipV6 := publicIface[0].IPv6
+		if ipV6 == nil {
+			return "", fmt.Errorf("public interface: %w", ErrNoIPv6)
+		}
+
+		return ipV6.IPAddress, nil
+	}
+	return "", ErrNoPublicInterface
+}
+
+// LocalAddresses returns the droplet's own ipv4 (or ipv6 when v6 is set)
+// addresses listed in metadata, in their canonical form
+func LocalAddresses(data *metadata.Metadata, v6 bool) []string {
+	lookups := []func(*metadata.Metadata) (string, error){PrivateAddress, PublicAddress, AnchorAddress, FloatingAddress}
+	if v6 {
+		lookups = []func(*metadata.Metadata) (string, error){PublicAddressV6}
+	}
+
+	addrs := []string{}
+	for _, lookup := range lookups {
+		addr, err := lookup(data)
+		if err != nil || addr == "" {
+			continue
+		}
+		addrs = append(addrs, canonicalIP(addr))
+	}
+	return addrs
+}
@@ -0,0 +1,370 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/go-metadata"
+)
+
+func TestLocalInterfaces(t *testing.T) {
+	ifaces, _ := net.Interfaces()
+
+	out, err := LocalInterfaces()
+	if err != nil || len(out) != len(ifaces) {
+		t.Logf("want:%v", ifaces)
+		t.Logf("got:%v %v", out, err)
+		t.Fatal("unexpected interfaces")
+	}
+	for i := range ifaces {
+		if out[i].Name != ifaces[i].Name || out[i].MAC != ifaces[i].HardwareAddr.String() {
+			t.Logf("want:%v", ifaces[i])
+			t.Logf("got:%v", out[i])
+			t.Fatal("unexpected interface")
+		}
+	}
+}
+
+func TestFindInterface(t *testing.T) {
+	lo := Interface{Name: "lo", Addrs: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}}
+	eth0 := Interface{Name: "eth0", MAC: "04:01:2a:0f:2a:01", Addrs: []net.IP{net.ParseIP("203.0.113.2"), net.ParseIP("2001:db8::2")}}
+	eth1 := Interface{Name: "eth1", MAC: "04:01:2a:0f:2a:02"}
+	// the address is on the bond, which shares the MAC of its slave
+	bondSlave := Interface{Name: "eth2", MAC: "04:01:2a:0f:2a:03"}
+	bond := Interface{Name: "bond0", MAC: "04:01:2a:0f:2a:03", Addrs: []net.IP{net.ParseIP("10.128.0.2")}}
+	ifaces := []Interface{lo, eth0, eth1, bondSlave, bond}
+
+	tests := []struct {
+		name   string
+		mac    string
+		local  string
+		exp    string
+		expErr string
+	}{
+		{
+			name:  "matching mac without the address",
+			mac:   "04:01:2a:0f:2a:02",
+			local: "10.132.0.2",
+			exp:   "eth1",
+		},
+		{
+			name:  "mac in a different case",
+			mac:   "04:01:2A:0F:2A:01",
+			local: "203.0.113.2",
+			exp:   "eth0",
+		},
+		{
+			name:  "shared mac prefers the interface with the address",
+			mac:   "04:01:2a:0f:2a:03",
+			local: "10.128.0.2",
+			exp:   "bond0",
+		},
+		{
+			name:  "unknown mac falls back to the address",
+			mac:   "04:01:2a:0f:2a:09",
+			local: "203.0.113.2",
+			exp:   "eth0",
+		},
+		{
+			name:  "expanded ipv6 address without a mac",
+			local: "2001:0DB8:0000:0000:0000:0000:0000:0002",
+			exp:   "eth0",
+		},
+		{
+			name:   "no matching interface",
+			mac:    "04:01:2a:0f:2a:09",
+			local:  "10.132.0.9",
+			expErr: "no interface with mac 04:01:2a:0f:2a:09 or address 10.132.0.9, inspected: lo [127.0.0.1 ::1], eth0 04:01:2a:0f:2a:01 [203.0.113.2 2001:db8::2], eth1 04:01:2a:0f:2a:02 [], eth2 04:01:2a:0f:2a:03 [], bond0 04:01:2a:0f:2a:03 [10.128.0.2]",
+		},
+		{
+			name:   "no matching interface without a mac",
+			local:  "somethingbad",
+			expErr: "no interface with address somethingbad, inspected: lo [127.0.0.1 ::1], eth0 04:01:2a:0f:2a:01 [203.0.113.2 2001:db8::2], eth1 04:01:2a:0f:2a:02 [], eth2 04:01:2a:0f:2a:03 [], bond0 04:01:2a:0f:2a:03 [10.128.0.2]",
+		},
+	}
+
+	for _, test := range tests {
+		out, err := FindInterface(ifaces, test.mac, test.local)
+		if (err == nil && test.expErr != "") || (err != nil && (err.Error() != test.expErr || !errors.Is(err, ErrInterfaceNotFound))) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if out != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestInterfaceMAC(t *testing.T) {
+	data := decodeMetadata(`{"interfaces": {"private": [{"mac": "04:01:2a:0f:2a:02"}]}}`)
+	if mac := PrivateMAC(data); mac != "04:01:2a:0f:2a:02" {
+		t.Fatalf("unexpected private mac %q", mac)
+	}
+	if mac := PublicMAC(data); mac != "" {
+		t.Fatalf("unexpected public mac %q", mac)
+	}
+}
+
+func TestPrivateAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   *metadata.Metadata
+		exp    string
+		expErr error
+	}{
+		{
+			name:   "private ipv4 address",
+			data:   decodeMetadata(`{"interfaces": {"private": [{"ipv4": {"ip_address": "privateIP"}}]}}`),
+			exp:    "privateIP",
+			expErr: nil,
+		},
+		{
+			name:   "private ipv6 address",
+			data:   decodeMetadata(`{"interfaces": {"private": [{"ipv6": {"ip_address": "privateIP"}}]}}`),
+			exp:    "",
+			expErr: ErrNoIPv4,
+		},
+		{
+			name:   "no private addresses",
+			data:   &metadata.Metadata{},
+			exp:    "",
+			expErr: ErrNoPrivateInterface,
+		},
+	}
+
+	for _, test := range tests {
+		out, err := PrivateAddress(test.data)
+		if !errors.Is(err, test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if out != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   *metadata.Metadata
+		exp    string
+		expErr error
+	}{
+		{
+			name:   "public ipv4 address",
+			data:   decodeMetadata(`{"interfaces": {"public": [{"ipv4": {"ip_address": "publicIP"}}]}}`),
+			exp:    "publicIP",
+			expErr: nil,
+		},
+		{
+			name:   "public ipv6 address",
+			data:   decodeMetadata(`{"interfaces": {"public": [{"ipv6": {"ip_address": "publicIP"}}]}}`),
+			exp:    "",
+			expErr: ErrNoIPv4,
+		},
+		{
+			name:   "no public addresses",
+			data:   &metadata.Metadata{},
+			exp:    "",
+			expErr: ErrNoPublicInterface,
+		},
+	}
+
+	for _, test := range tests {
+		out, err := PublicAddress(test.data)
+		if !errors.Is(err, test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if out != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestPublicAddressV6(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   *metadata.Metadata
+		exp    string
+		expErr error
+	}{
+		{
+			name:   "public ipv6 address",
+			data:   decodeMetadata(`{"interfaces": {"public": [{"ipv6": {"ip_address": "publicIP"}}]}}`),
+			exp:    "publicIP",
+			expErr: nil,
+		},
+		{
+			name:   "public ipv4 address",
+			data:   decodeMetadata(`{"interfaces": {"public": [{"ipv4": {"ip_address": "publicIP"}}]}}`),
+			exp:    "",
+			expErr: ErrNoIPv6,
+		},
+		{
+			name:   "no public addresses",
+			data:   &metadata.Metadata{},
+			exp:    "",
+			expErr: ErrNoPublicInterface,
+		},
+	}
+
+	for _, test := range tests {
+		out, err := PublicAddressV6(test.data)
+		if !errors.Is(err, test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if out != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestAnchorAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   *metadata.Metadata
+		exp    string
+		expErr error
+	}{
+		{
+			name:   "anchor ipv4 address",
+			data:   decodeMetadata(`{"interfaces": {"public": [{"ipv4": {"ip_address": "publicIP"}, "anchor_ipv4": {"ip_address": "anchorIP"}}]}}`),
+			exp:    "anchorIP",
+			expErr: nil,
+		},
+		{
+			name:   "no anchor address",
+			data:   decodeMetadata(`{"interfaces": {"public": [{"ipv4": {"ip_address": "publicIP"}}]}}`),
+			exp:    "",
+			expErr: ErrNoIPv4,
+		},
+		{
+			name:   "no public addresses",
+			data:   &metadata.Metadata{},
+			exp:    "",
+			expErr: ErrNoPublicInterface,
+		},
+	}
+
+	for _, test := range tests {
+		out, err := AnchorAddress(test.data)
+		if !errors.Is(err, test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if out != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestFloatingAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		exp    string
+		expErr string
+	}{
+		{
+			name: "active floating ip",
+			data: `{"floating_ip": {"ipv4": {"ip_address": "198.51.100.7", "active": true}}}`,
+			exp:  "198.51.100.7",
+		},
+		{
+			name:   "inactive floating ip",
+			data:   `{"floating_ip": {"ipv4": {"active": false}}}`,
+			expErr: "no active floating ip",
+		},
+		{
+			name:   "no floating ip",
+			data:   `{}`,
+			expErr: "no active floating ip",
+		},
+	}
+
+	for _, test := range tests {
+		out, err := FloatingAddress(decodeMetadata(test.data))
+		if out != test.exp || (err == nil && test.expErr != "") || (err != nil && err.Error() != test.expErr) {
+			t.Logf("want:%v %v", test.exp, test.expErr)
+			t.Logf("got:%v %v", out, err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestLocalAddresses(t *testing.T) {
+	data := decodeMetadata(`{"interfaces": {
+		"private": [{"ipv4": {"ip_address": "10.128.0.2"}}],
+		"public": [{
+			"ipv4": {"ip_address": "203.0.113.2"},
+			"ipv6": {"ip_address": "2001:0DB8:0000:0000:0000:0000:0000:0002"},
+			"anchor_ipv4": {"ip_address": "10.17.0.5"}
+		}]
+	}, "floating_ip": {"ipv4": {"ip_address": "198.51.100.7", "active": true}}}`)
+
+	tests := []struct {
+		name string
+		data *metadata.Metadata
+		v6   bool
+		exp  []string
+	}{
+		{
+			name: "ipv4 addresses",
+			data: data,
+			exp:  []string{"10.128.0.2", "203.0.113.2", "10.17.0.5", "198.51.100.7"},
+		},
+		{
+			name: "ipv6 addresses",
+			data: data,
+			v6:   true,
+			exp:  []string{"2001:db8::2"},
+		},
+		{
+			name: "no addresses",
+			data: &metadata.Metadata{},
+			exp:  []string{},
+		},
+	}
+
+	for _, test := range tests {
+		out := LocalAddresses(test.data, test.v6)
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func decodeMetadata(data string) *metadata.Metadata {
+	var output metadata.Metadata
+	var err error
+
+	err = json.NewDecoder(strings.NewReader(data)).Decode(&output)
+	if err != nil {
+		panic(err)
+	}
+	return &output
+}
@@ -0,0 +1,272 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/digitalocean/godo"
+)
+
+// Peer is the private address of a droplet along with the droplet's tags
+type Peer struct {
+	Address string
+	Tags    []string
+}
+
+// HasTag reports whether the peer's droplet has the tag
+func (p Peer) HasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SortDroplets returns a map (keyed by region slug) of droplets with private ip
+// interfaces
+func SortDroplets(droplets []godo.Droplet) map[string][]Peer {
+	netDrops := map[string][]Peer{}
+
+	for _, droplet := range droplets {
+		for _, net := range droplet.Networks.V4 {
+			if net.Type == "private" {
+				peer := Peer{Address: net.IPAddress, Tags: droplet.Tags}
+				netDrops[droplet.Region.Slug] = append(netDrops[droplet.Region.Slug], peer)
+			}
+		}
+	}
+
+	return netDrops
+}
+
+// Addresses returns the address of each peer
+func Addresses(peers []Peer) []string {
+	addrs := []string{}
+	for _, peer := range peers {
+		addrs = append(addrs, peer.Address)
+	}
+	return addrs
+}
+
+// PublicDroplets returns an array of all the public ip interfaces of the provided
+// droplets
+func PublicDroplets(droplets []godo.Droplet) []string {
+	netDrops := []string{}
+	for _, droplet := range droplets {
+		for _, net := range droplet.Networks.V4 {
+			if net.Type == "public" {
+				netDrops = append(netDrops, net.IPAddress)
+			}
+		}
+	}
+	return netDrops
+}
+
+// PublicDropletsV6 returns an array of all the public ipv6 addresses of the
+// provided droplets, in their canonical form
+func PublicDropletsV6(droplets []godo.Droplet) []string {
+	netDrops := []string{}
+	for _, droplet := range droplets {
+		for _, net := range droplet.Networks.V6 {
+			if net.Type == "public" {
+				netDrops = append(netDrops, canonicalIP(net.IPAddress))
+			}
+		}
+	}
+	return netDrops
+}
+
+// canonicalIP returns the address in the same form that iptables and nft list
+// it, leaving unparseable addresses untouched
+func canonicalIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	return ip.String()
+}
+
+// ParseAllowed parses a static address or CIDR into the form iptables lists it
+// in, and reports whether it is an ipv6 address
+func ParseAllowed(addr string) (string, bool, error) {
+	if strings.Contains(addr, "/") {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid CIDR %q", addr)
+		}
+		v6 := ip.To4() == nil
+		// single hosts are listed without their prefix length
+		if ones, bits := ipnet.Mask.Size(); ones == bits {
+			return ipnet.IP.String(), v6, nil
+		}
+		return ipnet.String(), v6, nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", false, fmt.Errorf("invalid address %q", addr)
+	}
+	return ip.String(), ip.To4() == nil, nil
+}
+
+// StaticPeers returns the ipv4 (or ipv6 when v6 is set) addresses and CIDRs of
+// a static allowlist in their canonical form. Invalid entries are skipped.
+func StaticPeers(allowed []string, v6 bool) []string {
+	peers := []string{}
+	for _, addr := range allowed {
+		peer, isV6, err := ParseAllowed(addr)
+		if err != nil || isV6 != v6 {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// MergePeers returns the discovered peers followed by the static peers which
+// are not already among them
+func MergePeers(discovered, static []string) []string {
+	peers := []string{}
+	seen := map[string]bool{}
+	for _, peer := range append(append([]string{}, discovered...), static...) {
+		if seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// DropletList paginates through the digitalocean API to return a list of all
+// droplets, stopping once the context is done
+func DropletList(ctx context.Context, ds godo.DropletsService) ([]godo.Droplet, error) {
+	// create a list to hold our droplets
+	list := []godo.Droplet{}
+
+	ds = serviceContext(ctx, ds)
+
+	// create options. initially, these will be blank
+	opt := &godo.ListOptions{}
+	for {
+		droplets, resp, err := listPage(ctx, func() ([]godo.Droplet, *godo.Response, error) {
+			return ds.List(opt)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		// append the current page's droplets to our list
+		for _, d := range droplets {
+			list = append(list, d)
+		}
+
+		// if we are at the last page, break out the for loop
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+
+		// set the page we want for the next request
+		opt.Page = page + 1
+	}
+
+	return list, nil
+}
+
+// DropletListTags paginates through the digitalocean API to return a list of
+// all droplets with the given tag, stopping once the context is done
+func DropletListTags(ctx context.Context, ds godo.DropletsService, tag string) ([]godo.Droplet, error) {
+	// create a list to hold our droplets
+	list := []godo.Droplet{}
+
+	ds = serviceContext(ctx, ds)
+
+	// create options. initially, these will be blank
+	opt := &godo.ListOptions{}
+	for {
+		droplets, resp, err := listPage(ctx, func() ([]godo.Droplet, *godo.Response, error) {
+			return ds.ListByTag(tag, opt)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		// append the current page's droplets to our list
+		for _, d := range droplets {
+			list = append(list, d)
+		}
+
+		// if we are at the last page, break out the for loop
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+
+		// set the page we want for the next request
+		opt.Page = page + 1
+	}
+
+	return list, nil
+}
+
+const (
+	// TagModeAny selects droplets with any of the tags
+	TagModeAny = "any"
+	// TagModeAll selects droplets with all of the tags
+	TagModeAll = "all"
+)
+
+// DropletListTagSet returns the droplets with any (TagModeAny) or all
+// (TagModeAll) of the given tags. Each tag is listed separately and droplets
+// are deduplicated by ID, keeping the order they were first listed in.
+func DropletListTagSet(ctx context.Context, ds godo.DropletsService, tags []string, mode string) ([]godo.Droplet, error) {
+	list := []godo.Droplet{}
+	counts := map[int]int{}
+
+	for _, tag := range tags {
+		droplets, err := DropletListTags(ctx, ds, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		// a droplet is only counted once per tag
+		seen := map[int]bool{}
+		for _, d := range droplets {
+			if seen[d.ID] {
+				continue
+			}
+			seen[d.ID] = true
+
+			if counts[d.ID] == 0 {
+				list = append(list, d)
+			}
+			counts[d.ID]++
+		}
+	}
+
+	if mode != TagModeAll {
+		return list, nil
+	}
+
+	all := []godo.Droplet{}
+	for _, d := range list {
+		if counts[d.ID] == len(tags) {
+			all = append(all, d)
+		}
+	}
+	return all, nil
+}
@@ -1,6 +1,7 @@
-package main
+package discovery
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
@@ -73,12 +74,12 @@ func TestDropletList(t *testing.T) {
 					return []godo.Droplet{{Name: "foobar"}}, resp, nil
 				},
 			},
-			expectedError: errors.New("parse page=): invalid URI for request"),
+			expectedError: errors.New(`parse "page=)": invalid URI for request`),
 		},
 	}
 
 	for _, test := range tests {
-		out, err := DropletList(test.ds)
+		out, err := DropletList(context.Background(), test.ds)
 		if !reflect.DeepEqual(err, test.expectedError) {
 			if err.Error() != test.expectedError.Error() {
 				t.Logf("want:%v", test.expectedError)
@@ -159,12 +160,12 @@ func TestDropletListTags(t *testing.T) {
 					return []godo.Droplet{{Name: "foobar"}}, resp, nil
 				},
 			},
-			expectedError: errors.New("parse page=): invalid URI for request"),
+			expectedError: errors.New(`parse "page=)": invalid URI for request`),
 		},
 	}
 
 	for _, test := range tests {
-		out, err := DropletListTags(test.ds, "access")
+		out, err := DropletListTags(context.Background(), test.ds, "access")
 		if !reflect.DeepEqual(err, test.expectedError) {
 			if err.Error() != test.expectedError.Error() {
 				t.Logf("want:%v", test.expectedError)
@@ -180,11 +181,73 @@ func TestDropletListTags(t *testing.T) {
 	}
 }
 
+func TestDropletListTagSet(t *testing.T) {
+	ds := &stubDropletService{
+		listTag: func(a string, b *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+			resp := &godo.Response{}
+			switch a {
+			case "prod":
+				return []godo.Droplet{{ID: 1, Name: "web"}, {ID: 2, Name: "db"}}, resp, nil
+			case "db":
+				return []godo.Droplet{{ID: 2, Name: "db"}, {ID: 3, Name: "staging-db"}}, resp, nil
+			}
+			return nil, nil, errors.New("bad tag")
+		},
+	}
+
+	tests := []struct {
+		name             string
+		tags             []string
+		mode             string
+		expectedDroplets []godo.Droplet
+		expectedError    error
+	}{
+		{
+			name:             "union of tags",
+			tags:             []string{"prod", "db"},
+			mode:             TagModeAny,
+			expectedDroplets: []godo.Droplet{{ID: 1, Name: "web"}, {ID: 2, Name: "db"}, {ID: 3, Name: "staging-db"}},
+		},
+		{
+			name:             "intersection of tags",
+			tags:             []string{"prod", "db"},
+			mode:             TagModeAll,
+			expectedDroplets: []godo.Droplet{{ID: 2, Name: "db"}},
+		},
+		{
+			name:             "single tag",
+			tags:             []string{"db"},
+			mode:             TagModeAll,
+			expectedDroplets: []godo.Droplet{{ID: 2, Name: "db"}, {ID: 3, Name: "staging-db"}},
+		},
+		{
+			name:          "list errors",
+			tags:          []string{"prod", "other"},
+			mode:          TagModeAny,
+			expectedError: errors.New("bad tag"),
+		},
+	}
+
+	for _, test := range tests {
+		out, err := DropletListTagSet(context.Background(), ds, test.tags, test.mode)
+		if !reflect.DeepEqual(err, test.expectedError) {
+			t.Logf("want:%v", test.expectedError)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(out, test.expectedDroplets) {
+			t.Logf("want:%v", test.expectedDroplets)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
 func TestSortDroplets(t *testing.T) {
 	tests := []struct {
 		name    string
 		droplet godo.Droplet
-		exp     map[string][]string
+		exp     map[string][]Peer
 	}{
 		{
 			name: "no private iface",
@@ -198,7 +261,7 @@ func TestSortDroplets(t *testing.T) {
 					},
 				},
 			},
-			exp: map[string][]string{},
+			exp: map[string][]Peer{},
 		},
 		{
 			name: "private iface",
@@ -212,8 +275,25 @@ func TestSortDroplets(t *testing.T) {
 					},
 				},
 			},
-			exp: map[string][]string{
-				"nyc1": []string{"192.168.0.0"},
+			exp: map[string][]Peer{
+				"nyc1": []Peer{{Address: "192.168.0.0"}},
+			},
+		},
+		{
+			name: "private iface with tags",
+			droplet: godo.Droplet{
+				Region: &godo.Region{
+					Slug: "nyc1",
+				},
+				Networks: &godo.Networks{
+					V4: []godo.NetworkV4{
+						godo.NetworkV4{IPAddress: "192.168.0.0", Type: "private"},
+					},
+				},
+				Tags: []string{"web", "monitoring"},
+			},
+			exp: map[string][]Peer{
+				"nyc1": []Peer{{Address: "192.168.0.0", Tags: []string{"web", "monitoring"}}},
 			},
 		},
 	}
@@ -274,6 +354,85 @@ func TestPublicDroplets(t *testing.T) {
 	}
 }
 
+func TestPublicDropletsV6(t *testing.T) {
+	tests := []struct {
+		name    string
+		droplet godo.Droplet
+		exp     []string
+	}{
+		{
+			name: "no ipv6 iface",
+			droplet: godo.Droplet{
+				Networks: &godo.Networks{
+					V4: []godo.NetworkV4{
+						godo.NetworkV4{IPAddress: "192.168.0.0", Type: "public"},
+					},
+				},
+			},
+			exp: []string{},
+		},
+		{
+			name: "public ipv6 iface",
+			droplet: godo.Droplet{
+				Networks: &godo.Networks{
+					V6: []godo.NetworkV6{
+						godo.NetworkV6{IPAddress: "2604:A880:0800:0010:0000:0000:0B07:4001", Type: "public"},
+					},
+				},
+			},
+			exp: []string{"2604:a880:800:10::b07:4001"},
+		},
+	}
+
+	for _, test := range tests {
+		out := PublicDropletsV6([]godo.Droplet{test.droplet})
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestStaticPeers(t *testing.T) {
+	allowed := []string{"10.0.0.1", "10.0.0.2/32", "192.168.1.7/24", "2001:DB8::1", "2001:db8::/32", "bogus"}
+
+	tests := []struct {
+		name string
+		v6   bool
+		exp  []string
+	}{
+		{
+			name: "ipv4 addresses and networks",
+			exp:  []string{"10.0.0.1", "10.0.0.2", "192.168.1.0/24"},
+		},
+		{
+			name: "ipv6 addresses and networks",
+			v6:   true,
+			exp:  []string{"2001:db8::1", "2001:db8::/32"},
+		},
+	}
+
+	for _, test := range tests {
+		out := StaticPeers(allowed, test.v6)
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestMergePeers(t *testing.T) {
+	out := MergePeers([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.2", "192.168.1.0/24", "192.168.1.0/24"})
+	exp := []string{"10.0.0.1", "10.0.0.2", "192.168.1.0/24"}
+	if !reflect.DeepEqual(out, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out)
+		t.Fatal("unexpected merged peers")
+	}
+}
+
 type stubDropletService struct {
 	list           func(*godo.ListOptions) ([]godo.Droplet, *godo.Response, error)
 	listTag        func(string, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error)
@@ -0,0 +1,206 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// minRetryBackoff is the delay before retrying the first failed request,
+	// and the shortest delay before any retry
+	minRetryBackoff = time.Second
+	// maxRetryBackoff caps the delay between retries of server and network
+	// errors
+	maxRetryBackoff = 30 * time.Second
+)
+
+// RetryError is returned once a DigitalOcean API request has failed and
+// retrying it again would exceed the retry budget
+type RetryError struct {
+	Attempts int
+	Waited   time.Duration
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("DigitalOcean API request failed after %d attempts over %s: %v", e.Attempts, e.Waited, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// retrier retries the DigitalOcean API requests droplan makes when they are
+// rate limited or fail with a server or network error. Rate limited requests
+// wait for the Retry-After header or the rate limit reset, other failures back
+// off exponentially, and every retry waits at least minRetryBackoff. A request
+// (each page of a listing is its own request) is not retried once the time
+// spent waiting for it would exceed the budget.
+type retrier struct {
+	budget time.Duration
+	logger *slog.Logger
+	// ctx stops the wait before a retry once it is done
+	ctx context.Context
+
+	now   func() time.Time
+	sleep func(context.Context, time.Duration) error
+}
+
+// newRetrier returns a retrier which waits at most budget for each request,
+// logging each retry to logger
+func newRetrier(budget time.Duration, logger *slog.Logger) retrier {
+	return retrier{
+		budget: budget,
+		logger: logger,
+		ctx:    context.Background(),
+		now:    time.Now,
+		sleep:  sleepContext,
+	}
+}
+
+// sleepContext waits for the duration, returning the context's error if it is
+// done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryingDroplets retries the List and ListByTag requests droplan makes
+type retryingDroplets struct {
+	godo.DropletsService
+	retrier
+}
+
+// RetryDroplets wraps ds to retry the List and ListByTag requests droplan
+// makes within the budget, logging each retry to logger
+func RetryDroplets(ds godo.DropletsService, budget time.Duration, logger *slog.Logger) godo.DropletsService {
+	return newRetryingDroplets(ds, budget, logger)
+}
+
+func newRetryingDroplets(ds godo.DropletsService, budget time.Duration, logger *slog.Logger) *retryingDroplets {
+	return &retryingDroplets{DropletsService: ds, retrier: newRetrier(budget, logger)}
+}
+
+func (r *retryingDroplets) withContext(ctx context.Context) godo.DropletsService {
+	c := *r
+	c.ctx = ctx
+	return &c
+}
+
+func (r *retryingDroplets) List(opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	return retry(&r.retrier, func() ([]godo.Droplet, *godo.Response, error) {
+		return r.DropletsService.List(opt)
+	})
+}
+
+func (r *retryingDroplets) ListByTag(tag string, opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	return retry(&r.retrier, func() ([]godo.Droplet, *godo.Response, error) {
+		return r.DropletsService.ListByTag(tag, opt)
+	})
+}
+
+// retry makes the request until it succeeds, fails with an error which is not
+// retried, or the retry budget is spent
+func retry[T any](r *retrier, request func() (T, *godo.Response, error)) (T, *godo.Response, error) {
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		v, resp, err := request()
+		if err == nil {
+			return v, resp, nil
+		}
+
+		wait, ok := r.retryWait(resp, err, attempt)
+		if !ok {
+			return v, resp, err
+		}
+		// a Retry-After of 0 or a rate limit reset in the past still waits, so
+		// the retries spend the budget instead of hammering the API
+		wait = max(wait, minRetryBackoff)
+		if waited+wait > r.budget {
+			return v, resp, &RetryError{Attempts: attempt, Waited: waited, Err: err}
+		}
+
+		r.logger.Warn("Retrying DigitalOcean API request", "attempt", attempt, "retry_in", wait.String(), "err", err)
+		if err := r.sleep(r.ctx, wait); err != nil {
+			return v, resp, err
+		}
+		waited += wait
+	}
+}
+
+// retryWait returns how long to wait before retrying a failed request, and
+// whether it should be retried at all
+func (r *retrier) retryWait(resp *godo.Response, err error, attempt int) (time.Duration, bool) {
+	if resp == nil || resp.Response == nil {
+		// only failures to reach the API are retried, not bad requests
+		var urlErr *url.Error
+		return retryBackoff(attempt), errors.As(err, &urlErr)
+	}
+
+	switch code := resp.StatusCode; {
+	case code == http.StatusTooManyRequests:
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After"), r.now()); ok {
+			return wait, true
+		}
+		if !resp.Rate.Reset.IsZero() {
+			wait := resp.Rate.Reset.Sub(r.now())
+			if wait < 0 {
+				wait = 0
+			}
+			return wait, true
+		}
+		return retryBackoff(attempt), true
+	case code >= 500:
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After"), r.now()); ok {
+			return wait, true
+		}
+		return retryBackoff(attempt), true
+	}
+	return 0, false
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		wait := at.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// retryBackoff returns the delay before the given retry attempt, doubling from
+// minRetryBackoff up to maxRetryBackoff
+func retryBackoff(attempt int) time.Duration {
+	wait := minRetryBackoff
+	for i := 1; i < attempt && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
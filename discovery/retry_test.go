@@ -0,0 +1,200 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestRetryingDroplets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	status := func(code int, header http.Header, rate godo.Rate) *godo.Response {
+		return &godo.Response{Response: &http.Response{StatusCode: code, Header: header}, Rate: rate}
+	}
+	apiErr := errors.New("api error")
+	netErr := &url.Error{Op: "Get", URL: "https://api.digitalocean.com/v2/droplets", Err: errors.New("connection refused")}
+
+	type result struct {
+		resp *godo.Response
+		err  error
+	}
+
+	tests := []struct {
+		name      string
+		budget    time.Duration
+		results   []result
+		exp       error
+		expSleeps []time.Duration
+	}{
+		{
+			name:   "waits for retry-after when rate limited",
+			budget: time.Minute,
+			results: []result{
+				{status(429, http.Header{"Retry-After": {"3"}}, godo.Rate{}), apiErr},
+				{status(200, nil, godo.Rate{}), nil},
+			},
+			expSleeps: []time.Duration{3 * time.Second},
+		},
+		{
+			name:   "waits for the rate limit reset",
+			budget: time.Minute,
+			results: []result{
+				{status(429, http.Header{}, godo.Rate{Reset: godo.Timestamp{Time: now.Add(10 * time.Second)}}), apiErr},
+				{status(200, nil, godo.Rate{}), nil},
+			},
+			expSleeps: []time.Duration{10 * time.Second},
+		},
+		{
+			name:   "waits at least the minimum backoff for retry-after 0",
+			budget: time.Minute,
+			results: []result{
+				{status(503, http.Header{"Retry-After": {"0"}}, godo.Rate{}), apiErr},
+				{status(200, nil, godo.Rate{}), nil},
+			},
+			expSleeps: []time.Duration{time.Second},
+		},
+		{
+			name:   "waits at least the minimum backoff for a past rate limit reset",
+			budget: time.Minute,
+			results: []result{
+				{status(429, http.Header{}, godo.Rate{Reset: godo.Timestamp{Time: now.Add(-time.Minute)}}), apiErr},
+				{status(200, nil, godo.Rate{}), nil},
+			},
+			expSleeps: []time.Duration{time.Second},
+		},
+		{
+			name:   "retry-after 0 spends the budget",
+			budget: time.Second,
+			results: []result{
+				{status(503, http.Header{"Retry-After": {"0"}}, godo.Rate{}), apiErr},
+				{status(503, http.Header{"Retry-After": {"0"}}, godo.Rate{}), apiErr},
+			},
+			exp:       &RetryError{Attempts: 2, Waited: time.Second, Err: apiErr},
+			expSleeps: []time.Duration{time.Second},
+		},
+		{
+			name:   "backs off on server errors",
+			budget: time.Minute,
+			results: []result{
+				{status(500, http.Header{}, godo.Rate{}), apiErr},
+				{status(502, http.Header{}, godo.Rate{}), apiErr},
+				{status(200, nil, godo.Rate{}), nil},
+			},
+			expSleeps: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:   "backs off on network errors",
+			budget: time.Minute,
+			results: []result{
+				{nil, netErr},
+				{status(200, nil, godo.Rate{}), nil},
+			},
+			expSleeps: []time.Duration{time.Second},
+		},
+		{
+			name:   "does not retry client errors",
+			budget: time.Minute,
+			results: []result{
+				{status(404, http.Header{}, godo.Rate{}), apiErr},
+			},
+			exp:       apiErr,
+			expSleeps: []time.Duration{},
+		},
+		{
+			name:   "gives up when the budget is spent",
+			budget: 2 * time.Second,
+			results: []result{
+				{status(503, http.Header{}, godo.Rate{}), apiErr},
+				{status(503, http.Header{}, godo.Rate{}), apiErr},
+			},
+			exp:       &RetryError{Attempts: 2, Waited: time.Second, Err: apiErr},
+			expSleeps: []time.Duration{time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		results := test.results
+		out := &bytes.Buffer{}
+		ds := newRetryingDroplets(&stubDropletService{
+			list: func(*godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+				r := results[0]
+				results = results[1:]
+				return nil, r.resp, r.err
+			},
+		}, test.budget, slog.New(slog.NewTextHandler(out, nil)))
+		ds.now = func() time.Time { return now }
+		sleeps := []time.Duration{}
+		ds.sleep = func(ctx context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			return nil
+		}
+
+		_, _, err := ds.List(&godo.ListOptions{})
+		if !reflect.DeepEqual(err, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(sleeps, test.expSleeps) {
+			t.Logf("want:%v", test.expSleeps)
+			t.Logf("got:%v", sleeps)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		// each retry is logged to the logger
+		if retries := strings.Count(out.String(), "Retrying DigitalOcean API request"); retries != len(test.expSleeps) {
+			t.Logf("want:%v", len(test.expSleeps))
+			t.Logf("got:%v", retries)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	unavailable := &godo.Response{Response: &http.Response{StatusCode: 503, Header: http.Header{}}}
+	ds := newRetryingDroplets(&stubDropletService{
+		list: func(*godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+			return nil, unavailable, errors.New("api error")
+		},
+	}, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// the wait of a second before the retry is cut short
+	start := time.Now()
+	_, _, err := ds.withContext(ctx).List(&godo.ListOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 500*time.Millisecond {
+		t.Logf("want:%v", context.DeadlineExceeded)
+		t.Logf("got:%v after %s", err, time.Since(start))
+		t.Fatal("unexpected retry error")
+	}
+}
+
+func TestRetryErrorMessage(t *testing.T) {
+	err := &RetryError{Attempts: 3, Waited: 3 * time.Second, Err: errors.New("503 Service Unavailable")}
+	exp := "DigitalOcean API request failed after 3 attempts over 3s: 503 Service Unavailable"
+	if err.Error() != exp {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", err)
+		t.Fatal("unexpected error message")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	exp := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, want := range exp {
+		if got := retryBackoff(i + 1); got != want {
+			t.Fatalf("attempt %d: want %s, got %s", i+1, want, got)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// GroupingVPC selects private peers in the local droplet's VPC
+	GroupingVPC = "vpc"
+	// GroupingRegion selects private peers in the local droplet's region
+	GroupingRegion = "region"
+)
+
+// VPCService looks up which VPC droplets are in. The vendored godo predates
+// VPCs, so it does not decode the vpc_uuid of droplets.
+type VPCService interface {
+	// DropletVPC returns the UUID of the VPC the droplet is in, or "" when it
+	// is not in one
+	DropletVPC(ctx context.Context, dropletID int) (string, *godo.Response, error)
+	// ListedVPCs returns the UUID of the VPC each droplet listed so far is in,
+	// keyed by droplet ID, without making a request
+	ListedVPCs() map[int]string
+}
+
+// VPCDroplets lists droplets with the godo client, keeping the vpc_uuid of
+// each listed droplet. Used as both the godo.DropletsService and the
+// VPCService, the peers in a VPC are found from the droplet list alone, which
+// does not need read access to VPCs.
+type VPCDroplets struct {
+	godo.DropletsService
+	client *godo.Client
+
+	mu   sync.Mutex
+	vpcs map[int]string
+}
+
+// NewVPCDroplets returns a VPCDroplets listing droplets with the godo client
+func NewVPCDroplets(client *godo.Client) *VPCDroplets {
+	return &VPCDroplets{DropletsService: client.Droplets, client: client, vpcs: map[int]string{}}
+}
+
+type vpcDroplet struct {
+	godo.Droplet
+	VPCUUID string `json:"vpc_uuid"`
+}
+
+type vpcDropletRoot struct {
+	Droplet vpcDroplet `json:"droplet"`
+}
+
+type vpcDropletsRoot struct {
+	Droplets []vpcDroplet `json:"droplets"`
+	Links    *godo.Links  `json:"links"`
+}
+
+func (d *VPCDroplets) List(opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	return d.list(url.Values{}, opt)
+}
+
+func (d *VPCDroplets) ListByTag(tag string, opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	return d.list(url.Values{"tag_name": {tag}}, opt)
+}
+
+func (d *VPCDroplets) list(query url.Values, opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	if opt != nil && opt.Page > 0 {
+		query.Set("page", strconv.Itoa(opt.Page))
+	}
+	if opt != nil && opt.PerPage > 0 {
+		query.Set("per_page", strconv.Itoa(opt.PerPage))
+	}
+	path := "v2/droplets"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	req, err := d.client.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root := new(vpcDropletsRoot)
+	resp, err := d.client.Do(req, root)
+	if err != nil {
+		return nil, resp, err
+	}
+	if root.Links != nil {
+		resp.Links = root.Links
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	droplets := []godo.Droplet{}
+	for _, droplet := range root.Droplets {
+		d.vpcs[droplet.ID] = droplet.VPCUUID
+		droplets = append(droplets, droplet.Droplet)
+	}
+	return droplets, resp, nil
+}
+
+func (d *VPCDroplets) DropletVPC(ctx context.Context, dropletID int) (string, *godo.Response, error) {
+	req, err := d.client.NewRequest("GET", fmt.Sprintf("v2/droplets/%d", dropletID), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req = req.WithContext(ctx)
+
+	root := new(vpcDropletRoot)
+	resp, err := d.client.Do(req, root)
+	if err != nil {
+		return "", resp, err
+	}
+	return root.Droplet.VPCUUID, resp, nil
+}
+
+func (d *VPCDroplets) ListedVPCs() map[int]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vpcs := map[int]string{}
+	for id, vpc := range d.vpcs {
+		vpcs[id] = vpc
+	}
+	return vpcs
+}
+
+// retryingVPCs retries the VPC requests droplan makes
+type retryingVPCs struct {
+	VPCService
+	retrier
+}
+
+// RetryVPCs wraps vs to retry requests within the budget, logging each retry
+// to logger
+func RetryVPCs(vs VPCService, budget time.Duration, logger *slog.Logger) VPCService {
+	return newRetryingVPCs(vs, budget, logger)
+}
+
+func newRetryingVPCs(vs VPCService, budget time.Duration, logger *slog.Logger) *retryingVPCs {
+	return &retryingVPCs{VPCService: vs, retrier: newRetrier(budget, logger)}
+}
+
+func (v *retryingVPCs) DropletVPC(ctx context.Context, dropletID int) (string, *godo.Response, error) {
+	r := v.retrier
+	r.ctx = ctx
+	return retry(&r, func() (string, *godo.Response, error) {
+		return v.VPCService.DropletVPC(ctx, dropletID)
+	})
+}
+
+// DropletVPCUUID returns the ID of the VPC the droplet is in, or "" when it is
+// not in a VPC, unless the context is done first
+func DropletVPCUUID(ctx context.Context, vs VPCService, dropletID int) (string, error) {
+	vpc, _, err := vs.DropletVPC(ctx, dropletID)
+	return vpc, err
+}
+
+// VPCPeers returns the private addresses of the droplets in the VPC, looked up
+// in vpcs by droplet ID
+func VPCPeers(droplets []godo.Droplet, vpcs map[int]string, vpc string) []Peer {
+	peers := []Peer{}
+	for _, droplet := range droplets {
+		if vpcs[droplet.ID] != vpc || droplet.Networks == nil {
+			continue
+		}
+		for _, net := range droplet.Networks.V4 {
+			if net.Type == "private" {
+				peers = append(peers, Peer{Address: net.IPAddress, Tags: droplet.Tags})
+			}
+		}
+	}
+	return peers
+}
@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestVPCDroplets(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("tag_name") == "db" {
+			fmt.Fprint(w, `{"droplets": [{"id": 2, "vpc_uuid": "vpc-2"}], "links": {}}`)
+			return
+		}
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"droplets": [{"id": 3}], "links": {}}`)
+			return
+		}
+		fmt.Fprint(w, `{"droplets": [{"id": 1, "name": "one", "vpc_uuid": "vpc-1"}], "links": {"pages": {"next": "http://example.com/v2/droplets?page=2", "last": "http://example.com/v2/droplets?page=2"}}}`)
+	})
+	mux.HandleFunc("/v2/droplets/4", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"droplet": {"id": 4, "vpc_uuid": "vpc-1"}}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := godo.NewClient(nil)
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	vd := NewVPCDroplets(client)
+
+	drops, err := DropletList(context.Background(), vd)
+	exp := []godo.Droplet{{ID: 1, Name: "one"}, {ID: 3}}
+	if err != nil || !reflect.DeepEqual(drops, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v %v", drops, err)
+		t.Fatal("unexpected droplets")
+	}
+	_, err = DropletListTags(context.Background(), vd, "db")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// droplets not in a VPC are listed without one
+	expVPCs := map[int]string{1: "vpc-1", 2: "vpc-2", 3: ""}
+	if vpcs := vd.ListedVPCs(); !reflect.DeepEqual(vpcs, expVPCs) {
+		t.Logf("want:%v", expVPCs)
+		t.Logf("got:%v", vpcs)
+		t.Fatal("unexpected listed vpcs")
+	}
+
+	vpc, err := DropletVPCUUID(context.Background(), vd, 4)
+	if err != nil || vpc != "vpc-1" {
+		t.Logf("want:%v", "vpc-1")
+		t.Logf("got:%v %v", vpc, err)
+		t.Fatal("unexpected droplet vpc")
+	}
+}
+
+func TestVPCDropletsContext(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	client := godo.NewClient(nil)
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err := NewVPCDroplets(client).DropletVPC(ctx, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Logf("want:%v", context.DeadlineExceeded)
+		t.Logf("got:%v", err)
+		t.Fatal("unexpected droplet vpc error")
+	}
+}
+
+func TestVPCPeers(t *testing.T) {
+	drops := []godo.Droplet{
+		{ID: 1, Tags: []string{"db"}, Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: "10.0.0.1", Type: "private"}, {IPAddress: "1.2.3.4", Type: "public"}}}},
+		{ID: 2, Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: "10.0.0.2", Type: "private"}}}},
+		{ID: 3, Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: "1.2.3.5", Type: "public"}}}},
+	}
+
+	exp := []Peer{{Address: "10.0.0.1", Tags: []string{"db"}}}
+	peers := VPCPeers(drops, map[int]string{1: "vpc-1", 2: "vpc-2", 3: "vpc-1"}, "vpc-1")
+	if !reflect.DeepEqual(peers, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", peers)
+		t.Fatal("unexpected vpc peers")
+	}
+}
+
+type stubVPCService struct {
+	dropletVPC func(int) (string, *godo.Response, error)
+	listedVPCs func() map[int]string
+}
+
+func (s *stubVPCService) DropletVPC(ctx context.Context, dropletID int) (string, *godo.Response, error) {
+	return s.dropletVPC(dropletID)
+}
+
+func (s *stubVPCService) ListedVPCs() map[int]string {
+	return s.listedVPCs()
+}
@@ -12,7 +12,7 @@ resource "digitalocean_ssh_key" "root_ssh" {
 }
 
 resource "digitalocean_droplet" "droplan-ubuntu-x64" {
-  image = "ubuntu-14-04-x64"
+  image = "ubuntu-16-04-x64"
   name = "droplan-ubuntu-x64"
   region = "nyc3"
   size = "512mb"
@@ -26,13 +26,14 @@ resource "digitalocean_droplet" "droplan-ubuntu-x64" {
       "curl -O -L https://github.com/tam7t/droplan/releases/download/v1.2.0/droplan_1.2.0_linux_amd64.tar.gz",
       "tar -zxf droplan_1.2.0_linux_amd64.tar.gz -C /usr/local/bin",
       "rm /tmp/droplan_1.2.0_linux_amd64.tar.gz",
-      "echo '${data.template_file.cron.rendered}' > /etc/cron.d/droplan"
+      "echo '${data.template_file.service.rendered}' > /etc/systemd/system/droplan.service",
+      "systemctl enable --now droplan"
     ]
   }
 }
 
 resource "digitalocean_droplet" "droplan-ubuntu-x32" {
-  image = "ubuntu-14-04-x32"
+  image = "ubuntu-16-04-x32"
   name = "droplan-ubuntu-x32"
   region = "nyc3"
   size = "512mb"
@@ -46,7 +47,8 @@ resource "digitalocean_droplet" "droplan-ubuntu-x32" {
       "curl -O -L https://github.com/tam7t/droplan/releases/download/v1.2.0/droplan_1.2.0_linux_386.tar.gz",
       "tar -zxf droplan_1.2.0_linux_386.tar.gz -C /usr/local/bin",
       "rm /tmp/droplan_1.2.0_linux_386.tar.gz",
-      "echo '${data.template_file.cron.rendered}' > /etc/cron.d/droplan"
+      "echo '${data.template_file.service.rendered}' > /etc/systemd/system/droplan.service",
+      "systemctl enable --now droplan"
     ]
   }
 }
@@ -65,7 +67,8 @@ resource "digitalocean_droplet" "droplan-fedora-x64" {
       "curl -O -L https://github.com/tam7t/droplan/releases/download/v1.2.0/droplan_1.2.0_linux_amd64.tar.gz",
       "tar -zxf droplan_1.2.0_linux_amd64.tar.gz -C /usr/local/bin",
       "rm droplan_1.2.0_linux_amd64.tar.gz",
-      "echo '${data.template_file.cron.rendered}' > /etc/cron.d/droplan"
+      "echo '${data.template_file.service.rendered}' > /etc/systemd/system/droplan.service",
+      "systemctl enable --now droplan"
     ]
   }
 }
@@ -83,7 +86,7 @@ resource "digitalocean_droplet" "droplan-coreos" {
 }
 
 resource "digitalocean_droplet" "droplan-ubuntu-x64-notag" {
-  image = "ubuntu-14-04-x64"
+  image = "ubuntu-16-04-x64"
   name = "droplan-ubuntu-x64-notag"
   region = "nyc3"
   size = "512mb"
@@ -96,7 +99,8 @@ resource "digitalocean_droplet" "droplan-ubuntu-x64-notag" {
       "curl -O -L https://github.com/tam7t/droplan/releases/download/v1.2.0/droplan_1.2.0_linux_amd64.tar.gz",
       "tar -zxf droplan_1.2.0_linux_amd64.tar.gz -C /usr/local/bin",
       "rm /tmp/droplan_1.2.0_linux_amd64.tar.gz",
-      "echo '${data.template_file.cron.rendered}' > /etc/cron.d/droplan"
+      "echo '${data.template_file.service.rendered}' > /etc/systemd/system/droplan.service",
+      "systemctl enable --now droplan"
     ]
   }
 }
@@ -110,8 +114,8 @@ data "template_file" "cloudinit" {
   }
 }
 
-data "template_file" "cron" {
-  template = "${file("${path.module}/templates/cron.tpl")}"
+data "template_file" "service" {
+  template = "${file("${path.module}/templates/droplan.service.tpl")}"
 
   vars {
     key = "${var.droplan_token}"
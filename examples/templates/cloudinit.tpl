@@ -25,15 +25,7 @@ coreos:
       Requires=docker.service
 
       [Service]
-      Type=oneshot
       Environment=DO_KEY=${key}
       Environment=DO_TAG=${tag}
-      ExecStart=/usr/bin/docker run --rm --net=host --cap-add=NET_ADMIN -e DO_KEY -e DO_TAG tam7t/droplan:latest
-  - name: droplan.timer
-    command: start
-    content: |
-      [Unit]
-      Description=Run droplan.service every 5 minutes
-
-      [Timer]
-      OnCalendar=*:0/5
+      ExecStart=/usr/bin/docker run --rm --net=host --cap-add=NET_ADMIN -e DO_KEY -e DO_TAG tam7t/droplan:latest daemon
+      Restart=on-failure
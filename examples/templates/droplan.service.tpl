@@ -0,0 +1,12 @@
+[Unit]
+Description=updates iptables with peer droplets
+After=network-online.target
+
+[Service]
+Environment=DO_KEY=${key}
+Environment=DO_TAG=${tag}
+ExecStart=/usr/local/bin/droplan daemon
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
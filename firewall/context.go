@@ -0,0 +1,111 @@
+package firewall
+
+import (
+	"context"
+
+	"github.com/tam7t/droplan/internal/ctxrun"
+)
+
+// contextIPTables runs the iptables commands of a single operation until its
+// context is done. go-iptables commands can not be interrupted, so a command
+// which is still running is left to finish in the background. Later commands
+// are not started, and the next reconcile repairs anything the abandoned
+// command left behind.
+type contextIPTables struct {
+	ipt IPTables
+	ctx context.Context
+}
+
+func (c *contextIPTables) ClearChain(table, chain string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ipt.ClearChain(table, chain) })
+}
+
+func (c *contextIPTables) Append(table, chain string, rulespec ...string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ipt.Append(table, chain, rulespec...) })
+}
+
+func (c *contextIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ipt.AppendUnique(table, chain, rulespec...) })
+}
+
+func (c *contextIPTables) NewChain(table, chain string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ipt.NewChain(table, chain) })
+}
+
+func (c *contextIPTables) Delete(table, chain string, rulespec ...string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ipt.Delete(table, chain, rulespec...) })
+}
+
+func (c *contextIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return ctxrun.Run(c.ctx, func() (bool, error) { return c.ipt.Exists(table, chain, rulespec...) })
+}
+
+func (c *contextIPTables) List(table, chain string) ([]string, error) {
+	return ctxrun.Run(c.ctx, func() ([]string, error) { return c.ipt.List(table, chain) })
+}
+
+func (c *contextIPTables) DeleteChain(table, chain string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ipt.DeleteChain(table, chain) })
+}
+
+// ipsetContexter is implemented by an IPSet which can kill its commands when a
+// context is done
+type ipsetContexter interface {
+	withContext(context.Context) IPSet
+}
+
+// nftContexter is implemented by an NFTables which can kill its commands when
+// a context is done
+type nftContexter interface {
+	withContext(context.Context) NFTables
+}
+
+// contextIPSet runs the ipset commands of a single operation until its context
+// is done. The commands are killed as well when ips is an ipsetContexter.
+type contextIPSet struct {
+	ips IPSet
+	ctx context.Context
+}
+
+func (c *contextIPSet) Create(set, typ string, opts ...string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ips.Create(set, typ, opts...) })
+}
+
+func (c *contextIPSet) Add(set, entry string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ips.Add(set, entry) })
+}
+
+func (c *contextIPSet) List(set string) ([]string, error) {
+	return ctxrun.Run(c.ctx, func() ([]string, error) { return c.ips.List(set) })
+}
+
+func (c *contextIPSet) Flush(set string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ips.Flush(set) })
+}
+
+func (c *contextIPSet) Swap(from, to string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ips.Swap(from, to) })
+}
+
+func (c *contextIPSet) Destroy(set string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.ips.Destroy(set) })
+}
+
+// contextNFTables runs the nft commands of a single operation until its
+// context is done. The commands are killed as well when nft is an nftContexter.
+type contextNFTables struct {
+	nft NFTables
+	ctx context.Context
+}
+
+func (c *contextNFTables) Apply(script string) error {
+	return ctxrun.RunErr(c.ctx, func() error { return c.nft.Apply(script) })
+}
+
+func (c *contextNFTables) ListSet(family, table, set string) ([]string, error) {
+	return ctxrun.Run(c.ctx, func() ([]string, error) { return c.nft.ListSet(family, table, set) })
+}
+
+func (c *contextNFTables) ListTable(family, table string) ([]string, error) {
+	return ctxrun.Run(c.ctx, func() ([]string, error) { return c.nft.ListTable(family, table) })
+}
@@ -0,0 +1,82 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFirewallContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ipt := &stubIPTables{
+		newChain: func(string, string) error {
+			t.Fatal("command run after the context was done")
+			return nil
+		},
+		list: func(string, string) ([]string, error) {
+			t.Fatal("command run after the context was done")
+			return nil, nil
+		},
+	}
+	fw := NewIPTablesFirewall(ipt, false)
+
+	err := fw.Setup(ctx, "eth1", "droplan-peers")
+	if !errors.Is(err, context.Canceled) {
+		t.Logf("want:%v", context.Canceled)
+		t.Logf("got:%v", err)
+		t.Fatal("unexpected setup error")
+	}
+	_, err = fw.Peers(ctx, "droplan-peers")
+	if !errors.Is(err, context.Canceled) {
+		t.Logf("want:%v", context.Canceled)
+		t.Logf("got:%v", err)
+		t.Fatal("unexpected peers error")
+	}
+}
+
+func TestCommandContext(t *testing.T) {
+	path, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not installed")
+	}
+
+	tests := []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{
+			name: "ipset",
+			run: func(ctx context.Context) error {
+				ips := (&ipsetCmd{path: path}).withContext(ctx)
+				_, err := ips.(*ipsetCmd).run("10")
+				return err
+			},
+		},
+		{
+			name: "nft",
+			run: func(ctx context.Context) error {
+				nft := (&nftCmd{path: path}).withContext(ctx)
+				_, err := nft.(*nftCmd).run(nil, "10")
+				return err
+			},
+		},
+	}
+
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		start := time.Now()
+		err := test.run(ctx)
+		cancel()
+		// the command is killed rather than left running for ten seconds
+		if err == nil || !strings.Contains(err.Error(), "killed") || time.Since(start) > 5*time.Second {
+			t.Logf("want:killed command")
+			t.Logf("got:%v after %s", err, time.Since(start))
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// dryRunIPTables implements IPTables by reading the current rules from an
+// underlying IPTables (when one is available) and writing the commands that
+// would change them to out instead of running them
+type dryRunIPTables struct {
+	ipt IPTables
+	cmd string
+	out io.Writer
+	// chains records the chains the dry run created (true) or deleted (false)
+	chains map[string]bool
+}
+
+// newDryRunIPTables wraps ipt, which may be nil when iptables is not
+// installed, for a dry run
+func newDryRunIPTables(ipt *iptables.IPTables, proto iptables.Protocol, out io.Writer) *dryRunIPTables {
+	d := &dryRunIPTables{cmd: "iptables", out: out}
+	if proto == iptables.ProtocolIPv6 {
+		d.cmd = "ip6tables"
+	}
+	if ipt != nil {
+		d.ipt = ipt
+	}
+	return d
+}
+
+func (d *dryRunIPTables) print(table string, args ...string) {
+	fmt.Fprintln(d.out, strings.Join(append([]string{d.cmd, "-t", table}, args...), " "))
+}
+
+// chainExists reports whether the chain would exist at this point of the dry
+// run
+func (d *dryRunIPTables) chainExists(table, chain string) bool {
+	_, err := d.List(table, chain)
+	return err == nil
+}
+
+// setChain records that the dry run created or deleted the chain
+func (d *dryRunIPTables) setChain(table, chain string, exists bool) {
+	if d.chains == nil {
+		d.chains = map[string]bool{}
+	}
+	d.chains[table+" "+chain] = exists
+}
+
+func (d *dryRunIPTables) ClearChain(table, chain string) error {
+	if d.chainExists(table, chain) {
+		d.print(table, "-F", chain)
+	} else {
+		d.print(table, "-N", chain)
+		d.setChain(table, chain, true)
+	}
+	return nil
+}
+
+func (d *dryRunIPTables) Append(table, chain string, rulespec ...string) error {
+	d.print(table, append([]string{"-A", chain}, rulespec...)...)
+	return nil
+}
+
+func (d *dryRunIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := d.Exists(table, chain, rulespec...)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return d.Append(table, chain, rulespec...)
+	}
+	return nil
+}
+
+func (d *dryRunIPTables) NewChain(table, chain string) error {
+	if !d.chainExists(table, chain) {
+		d.print(table, "-N", chain)
+		d.setChain(table, chain, true)
+	}
+	return nil
+}
+
+func (d *dryRunIPTables) Delete(table, chain string, rulespec ...string) error {
+	d.print(table, append([]string{"-D", chain}, rulespec...)...)
+	return nil
+}
+
+func (d *dryRunIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	if d.ipt == nil {
+		return false, nil
+	}
+	return d.ipt.Exists(table, chain, rulespec...)
+}
+
+func (d *dryRunIPTables) List(table, chain string) ([]string, error) {
+	created, ok := d.chains[table+" "+chain]
+	if ok && !created {
+		return nil, fmt.Errorf("%s: chain %s does not exist", d.cmd, chain)
+	}
+	if d.ipt != nil {
+		rules, err := d.ipt.List(table, chain)
+		if err == nil || !ok {
+			return rules, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: chain %s does not exist", d.cmd, chain)
+	}
+	// the chain was created by the dry run, so it would be empty
+	return []string{}, nil
+}
+
+func (d *dryRunIPTables) DeleteChain(table, chain string) error {
+	d.print(table, "-X", chain)
+	d.setChain(table, chain, false)
+	return nil
+}
+
+// dryRunIPSet implements IPSet by reading the current sets from an underlying
+// IPSet (when one is available) and writing the commands that would change
+// them to out instead of running them
+type dryRunIPSet struct {
+	ips IPSet
+	out io.Writer
+	// sets records the sets the dry run created (true) or destroyed (false)
+	sets map[string]bool
+}
+
+// newDryRunIPSet wraps ips, which may be nil when ipset is not installed, for
+// a dry run
+func newDryRunIPSet(ips *ipsetCmd, out io.Writer) *dryRunIPSet {
+	d := &dryRunIPSet{out: out, sets: map[string]bool{}}
+	if ips != nil {
+		d.ips = ips
+	}
+	return d
+}
+
+// withContext returns a copy of the dry run which reads the current sets with
+// ctx, and shares the sets it created or destroyed
+func (d *dryRunIPSet) withContext(ctx context.Context) IPSet {
+	c := &dryRunIPSet{ips: d.ips, out: d.out, sets: d.sets}
+	if ips, ok := d.ips.(ipsetContexter); ok {
+		c.ips = ips.withContext(ctx)
+	}
+	return c
+}
+
+func (d *dryRunIPSet) print(args ...string) {
+	fmt.Fprintln(d.out, strings.Join(append([]string{"ipset"}, args...), " "))
+}
+
+func (d *dryRunIPSet) Create(set, typ string, opts ...string) error {
+	d.print(append(append([]string{"create", set, typ}, opts...), "-exist")...)
+	if _, err := d.List(set); err != nil {
+		d.sets[set] = true
+	}
+	return nil
+}
+
+func (d *dryRunIPSet) Add(set, entry string) error {
+	d.print("add", set, entry, "-exist")
+	return nil
+}
+
+func (d *dryRunIPSet) List(set string) ([]string, error) {
+	created, ok := d.sets[set]
+	if ok && !created {
+		return nil, fmt.Errorf("ipset: set %s does not exist", set)
+	}
+	if d.ips != nil {
+		entries, err := d.ips.List(set)
+		if err == nil || !ok {
+			return entries, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("ipset: set %s does not exist", set)
+	}
+	// the set was created by the dry run, so it would be empty
+	return []string{}, nil
+}
+
+func (d *dryRunIPSet) Flush(set string) error {
+	d.print("flush", set)
+	return nil
+}
+
+func (d *dryRunIPSet) Swap(from, to string) error {
+	d.print("swap", from, to)
+	return nil
+}
+
+func (d *dryRunIPSet) Destroy(set string) error {
+	d.print("destroy", set)
+	d.sets[set] = false
+	return nil
+}
+
+// dryRunNFTables implements NFTables by reading the current sets from an
+// underlying NFTables (when one is available) and writing the scripts that
+// would change them to out instead of applying them
+type dryRunNFTables struct {
+	nft NFTables
+	out io.Writer
+	// sets records the sets the scripts added (true) or deleted (false), by
+	// family, table and name
+	sets map[string]bool
+}
+
+// newDryRunNFTables wraps nft, which may be nil when nft is not installed, for
+// a dry run
+func newDryRunNFTables(nft *nftCmd, out io.Writer) *dryRunNFTables {
+	d := &dryRunNFTables{out: out, sets: map[string]bool{}}
+	if nft != nil {
+		d.nft = nft
+	}
+	return d
+}
+
+// withContext returns a copy of the dry run which reads the current sets with
+// ctx, and shares the sets its scripts added or deleted
+func (d *dryRunNFTables) withContext(ctx context.Context) NFTables {
+	c := &dryRunNFTables{nft: d.nft, out: d.out, sets: d.sets}
+	if nft, ok := d.nft.(nftContexter); ok {
+		c.nft = nft.withContext(ctx)
+	}
+	return c
+}
+
+func (d *dryRunNFTables) Apply(script string) error {
+	fmt.Fprintf(d.out, "nft -f - <<EOF\n%sEOF\n", script)
+
+	// the scripts droplan applies add and delete sets with one command per line
+	for _, line := range strings.Split(script, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[1] != "set" {
+			continue
+		}
+		key := strings.Join(fields[2:5], " ")
+		switch fields[0] {
+		case "add":
+			if _, err := d.ListSet(fields[2], fields[3], fields[4]); err != nil {
+				d.sets[key] = true
+			}
+		case "delete":
+			d.sets[key] = false
+		}
+	}
+	return nil
+}
+
+func (d *dryRunNFTables) ListSet(family, table, set string) ([]string, error) {
+	created, ok := d.sets[family+" "+table+" "+set]
+	if ok && !created {
+		return nil, fmt.Errorf("nft: set %s does not exist", set)
+	}
+	if d.nft != nil {
+		elements, err := d.nft.ListSet(family, table, set)
+		if err == nil || !ok {
+			return elements, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("nft: set %s does not exist", set)
+	}
+	// the set was added by the dry run, so it would be empty
+	return []string{}, nil
+}
+
+func (d *dryRunNFTables) ListTable(family, table string) ([]string, error) {
+	if d.nft == nil {
+		return []string{}, nil
+	}
+	return d.nft.ListTable(family, table)
+}
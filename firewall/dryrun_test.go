@@ -0,0 +1,189 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestDryRunIPTables(t *testing.T) {
+	tests := []struct {
+		name  string
+		ipt   IPTables
+		peers []string
+		exp   string
+	}{
+		{
+			name:  "without iptables everything is created",
+			peers: []string{"peer1"},
+			exp: `iptables -t filter -N droplan-peers
+iptables -t filter -A INPUT -i eth1 -j droplan-peers
+iptables -t filter -A INPUT -i eth1 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+iptables -t filter -A INPUT -i eth1 -j DROP
+iptables -t filter -A droplan-peers -s peer1 -j ACCEPT
+`,
+		},
+		{
+			name: "only the difference against current rules is printed",
+			ipt: func() IPTables {
+				s := newStubIPTables()
+				s.exists = func(string, string, ...string) (bool, error) { return true, nil }
+				s.list = func(a, b string) ([]string, error) {
+					return []string{
+						"-N droplan-peers",
+						"-A droplan-peers -s peer1/32 -j ACCEPT",
+						"-A droplan-peers -s peer2/32 -j ACCEPT",
+					}, nil
+				}
+				s.append = func(string, string, ...string) error {
+					t.Fatal("dry run must not append")
+					return nil
+				}
+				s.delete = func(string, string, ...string) error {
+					t.Fatal("dry run must not delete")
+					return nil
+				}
+				return s
+			}(),
+			peers: []string{"peer2", "peer3"},
+			exp: `iptables -t filter -A droplan-peers -s peer3 -j ACCEPT
+iptables -t filter -D droplan-peers -s peer1/32 -j ACCEPT
+`,
+		},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		fw := &iptablesFirewall{ipt: &dryRunIPTables{ipt: test.ipt, cmd: "iptables", out: out}}
+
+		err := fw.Setup(context.Background(), "eth1", "droplan-peers")
+		if err != nil {
+			t.Fatalf("test case failed: %s: %v", test.name, err)
+		}
+		_, err = fw.UpdatePeers(context.Background(), test.peers, "droplan-peers")
+		if err != nil {
+			t.Fatalf("test case failed: %s: %v", test.name, err)
+		}
+
+		if out.String() != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out.String())
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestDryRunIPSet(t *testing.T) {
+	out := &bytes.Buffer{}
+	ips := newDryRunIPSet(nil, out)
+
+	// the set does not exist until it is created
+	_, err := UpdateSetPeers(ips, []string{"peer1"}, "droplan-peers", "inet")
+	if err == nil {
+		t.Fatal("expected an error for a missing set")
+	}
+
+	err = ips.Create("droplan-peers", "hash:ip", "family", "inet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = UpdateSetPeers(ips, []string{"peer1"}, "droplan-peers", "inet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := `ipset create droplan-peers hash:ip family inet -exist
+ipset create droplan-peers-new hash:ip family inet -exist
+ipset flush droplan-peers-new
+ipset add droplan-peers-new peer1 -exist
+ipset swap droplan-peers-new droplan-peers
+ipset destroy droplan-peers-new
+`
+	if out.String() != exp {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out.String())
+		t.Fatal("unexpected ipset commands")
+	}
+}
+
+func TestDryRunNFTables(t *testing.T) {
+	out := &bytes.Buffer{}
+	nft := newDryRunNFTables(nil, out)
+
+	// the set does not exist until a script adds it
+	_, err := UpdateNFTPeers(nft, []string{"peer1"}, "droplan-peers")
+	if err == nil {
+		t.Fatal("expected an error for a missing set")
+	}
+
+	err = nft.Apply("add set inet droplan droplan-peers { type ipv4_addr; }\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out.Reset()
+	_, err = UpdateNFTPeers(nft, []string{"peer1"}, "droplan-peers")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := "nft -f - <<EOF\n" +
+		"flush set inet droplan droplan-peers\n" +
+		"add element inet droplan droplan-peers { peer1 }\n" +
+		"EOF\n"
+	if out.String() != exp {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out.String())
+		t.Fatal("unexpected nft script")
+	}
+}
+
+func TestDryRunTeardown(t *testing.T) {
+	tests := []struct {
+		name     string
+		teardown func(out *bytes.Buffer) error
+		exp      string
+	}{
+		{
+			name: "iptables chain which does not exist",
+			teardown: func(out *bytes.Buffer) error {
+				return Teardown(&dryRunIPTables{cmd: "iptables", out: out}, "eth1", "droplan-peers", false)
+			},
+			exp: "",
+		},
+		{
+			name: "iptables chain created by the dry run",
+			teardown: func(out *bytes.Buffer) error {
+				ipt := &dryRunIPTables{cmd: "iptables", out: out}
+				err := Setup(ipt, "eth1", "droplan-peers", false)
+				if err != nil {
+					return err
+				}
+				out.Reset()
+				return Teardown(ipt, "eth1", "droplan-peers", false)
+			},
+			exp: `iptables -t filter -F droplan-peers
+iptables -t filter -X droplan-peers
+`,
+		},
+		{
+			name: "ipset which does not exist",
+			teardown: func(out *bytes.Buffer) error {
+				return TeardownSet(&dryRunIPTables{cmd: "iptables", out: out}, newDryRunIPSet(nil, out), "eth1", "droplan-peers", "inet")
+			},
+			exp: "",
+		},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := test.teardown(out)
+		if err != nil {
+			t.Fatalf("test case failed: %s: %v", test.name, err)
+		}
+		if out.String() != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out.String())
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/tam7t/droplan/discovery"
+)
+
+// Firewall is implemented by each backend that droplan can use to restrict
+// traffic on an interface to a list of peers. No further commands are run
+// once the context passed to a method is done.
+type Firewall interface {
+	// Setup prepares the named chain (or set) for holding peers and denies
+	// all other traffic on the interface
+	Setup(ctx context.Context, iface, chain string) error
+	// UpdatePeers replaces the peers held by the named chain (or set)
+	UpdatePeers(ctx context.Context, peers []string, chain string) (PeerChanges, error)
+	// Teardown removes everything Setup added for the interface and the
+	// named chain (or set). Anything which does not exist is skipped.
+	Teardown(ctx context.Context, iface, chain string) error
+	// Check returns an error when the named chain (or set) does not exist
+	Check(ctx context.Context, chain string) error
+	// Peers returns the peers currently held by the named chain (or set)
+	Peers(ctx context.Context, chain string) ([]string, error)
+}
+
+// PolicyFirewall is implemented by backends which can limit peers to the ports
+// allowed by policies
+type PolicyFirewall interface {
+	// UpdatePolicies replaces the peers held by the named chain with the
+	// peers allowed by each policy and the allowed addresses
+	UpdatePolicies(ctx context.Context, peers []discovery.Peer, allowed []string, policies []Policy, chain string) (PeerChanges, error)
+}
+
+// iptablesFirewall keeps peers as one rule per peer in an iptables chain
+type iptablesFirewall struct {
+	ipt IPTables
+	v6  bool
+}
+
+// NewIPTablesFirewall returns the iptables backend, running its commands with
+// ipt, which is ip6tables when v6 is set
+func NewIPTablesFirewall(ipt IPTables, v6 bool) Firewall {
+	return &iptablesFirewall{ipt: ipt, v6: v6}
+}
+
+func (f *iptablesFirewall) Setup(ctx context.Context, iface, chain string) error {
+	return Setup(f.withContext(ctx), iface, chain, f.v6)
+}
+
+func (f *iptablesFirewall) UpdatePeers(ctx context.Context, peers []string, chain string) (PeerChanges, error) {
+	return UpdatePeers(f.withContext(ctx), peers, chain)
+}
+
+func (f *iptablesFirewall) UpdatePolicies(ctx context.Context, peers []discovery.Peer, allowed []string, policies []Policy, chain string) (PeerChanges, error) {
+	return UpdatePolicies(f.withContext(ctx), peers, allowed, policies, chain)
+}
+
+func (f *iptablesFirewall) Teardown(ctx context.Context, iface, chain string) error {
+	return Teardown(f.withContext(ctx), iface, chain, f.v6)
+}
+
+func (f *iptablesFirewall) Check(ctx context.Context, chain string) error {
+	_, err := f.withContext(ctx).List("filter", chain)
+	return err
+}
+
+func (f *iptablesFirewall) Peers(ctx context.Context, chain string) ([]string, error) {
+	return ListPeers(f.withContext(ctx), chain)
+}
+
+func (f *iptablesFirewall) withContext(ctx context.Context) IPTables {
+	return &contextIPTables{ipt: f.ipt, ctx: ctx}
+}
+
+// New returns the firewall backend with the given name, filtering
+// IPv6 traffic (with ip6tables) when v6 is set. The "auto" backend uses
+// iptables unless iptables is not installed or is the nf_tables compatibility
+// shim without any existing droplan chains, in which case nftables is used.
+//
+// When dryRun is not nil the backend only reads the current rules, and the
+// commands that would change them are written to dryRun instead of being run.
+func New(backend string, v6 bool, dryRun io.Writer) (Firewall, error) {
+	if backend == "auto" {
+		backend = detectBackend()
+	}
+
+	proto := iptables.ProtocolIPv4
+	ipsetFamily, nftAddrFamily := "inet", "ip"
+	if v6 {
+		proto = iptables.ProtocolIPv6
+		ipsetFamily, nftAddrFamily = "inet6", "ip6"
+	}
+
+	switch backend {
+	case "iptables":
+		ipt, err := newIPTables(proto, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		return &iptablesFirewall{ipt: ipt, v6: v6}, nil
+	case "ipset":
+		ipt, err := newIPTables(proto, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := newIPSet()
+		if dryRun != nil {
+			return &ipsetFirewall{ipt: ipt, ips: newDryRunIPSet(ips, dryRun), family: ipsetFamily}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &ipsetFirewall{ipt: ipt, ips: ips, family: ipsetFamily}, nil
+	case "nftables":
+		nft, err := newNFTables()
+		if dryRun != nil {
+			return &nftFirewall{nft: newDryRunNFTables(nft, dryRun), family: nftAddrFamily}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &nftFirewall{nft: nft, family: nftAddrFamily}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q", backend)
+}
+
+// NewAll returns a firewall for each backend whose commands are installed,
+// filtering IPv6 traffic when v6 is set. It is used to tear down rules without
+// knowing which backend added them.
+func NewAll(v6 bool, dryRun io.Writer) []Firewall {
+	fws := []Firewall{}
+	for _, backend := range []string{"iptables", "ipset", "nftables"} {
+		if !installed(backend, v6) {
+			continue
+		}
+		fw, err := New(backend, v6, dryRun)
+		if err != nil {
+			continue
+		}
+		fws = append(fws, fw)
+	}
+	return fws
+}
+
+// installed reports whether the commands run by the backend are in the PATH
+func installed(backend string, v6 bool) bool {
+	iptablesCmd := "iptables"
+	if v6 {
+		iptablesCmd = "ip6tables"
+	}
+	commands := map[string][]string{
+		"iptables": {iptablesCmd},
+		"ipset":    {iptablesCmd, "ipset"},
+		"nftables": {"nft"},
+	}[backend]
+
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err != nil {
+			return false
+		}
+	}
+	return len(commands) > 0
+}
+
+// newIPTables returns an IPTables for the protocol, wrapped for a dry run when
+// dryRun is not nil
+func newIPTables(proto iptables.Protocol, dryRun io.Writer) (IPTables, error) {
+	ipt, err := iptables.NewWithProtocol(proto)
+	if dryRun != nil {
+		// a dry run does not need iptables to be installed, it just can not
+		// compare against the current rules
+		return newDryRunIPTables(ipt, proto, dryRun), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ipt, nil
+}
+
+// detectBackend picks the backend for the "auto" setting
+func detectBackend() string {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return "iptables"
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		// no usable iptables, but nft is installed
+		return "nftables"
+	}
+
+	out, err := exec.Command("iptables", "--version").Output()
+	if err != nil || !strings.Contains(string(out), "nf_tables") {
+		return "iptables"
+	}
+
+	// keep using iptables on hosts which droplan already manages that way so
+	// that the existing rules are not left behind
+	chains, err := ipt.ListChains("filter")
+	if err != nil {
+		return "iptables"
+	}
+	for _, chain := range chains {
+		if strings.HasPrefix(chain, "droplan-") {
+			return "iptables"
+		}
+	}
+	return "nftables"
+}
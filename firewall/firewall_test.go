@@ -0,0 +1,17 @@
+package firewall
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New("pf", false, nil)
+	exp := errors.New(`unknown firewall backend "pf"`)
+	if !reflect.DeepEqual(err, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", err)
+		t.Fatal("test case failed: unknown backend")
+	}
+}
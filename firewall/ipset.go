@@ -0,0 +1,280 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// IPSet interface for interacting with the ipset command. Declare it this way
+// so that it is easy to dependency inject a mock.
+type IPSet interface {
+	Create(string, string, ...string) error
+	Add(string, string) error
+	List(string) ([]string, error)
+	Flush(string) error
+	Swap(string, string) error
+	Destroy(string) error
+}
+
+// ipsetCmd implements IPSet by running the ipset binary. Commands are killed
+// when ctx is done.
+type ipsetCmd struct {
+	path string
+	ctx  context.Context
+}
+
+// newIPSet returns an IPSet backed by the ipset binary found in the PATH
+func newIPSet() (*ipsetCmd, error) {
+	path, err := exec.LookPath("ipset")
+	if err != nil {
+		return nil, err
+	}
+	return &ipsetCmd{path: path, ctx: context.Background()}, nil
+}
+
+// withContext returns a copy of the ipsetCmd which runs its commands with ctx
+func (i *ipsetCmd) withContext(ctx context.Context) IPSet {
+	return &ipsetCmd{path: i.path, ctx: ctx}
+}
+
+// Create creates a set of the given type (with any create options) if it does
+// not already exist
+func (i *ipsetCmd) Create(set, typ string, opts ...string) error {
+	args := append([]string{"create", set, typ}, opts...)
+	_, err := i.run(append(args, "-exist")...)
+	return err
+}
+
+// Add adds an entry to the set if it is not already a member
+func (i *ipsetCmd) Add(set, entry string) error {
+	_, err := i.run("add", set, entry, "-exist")
+	return err
+}
+
+// List returns the entries of the set
+func (i *ipsetCmd) List(set string) ([]string, error) {
+	out, err := i.run("save", set)
+	if err != nil {
+		return nil, err
+	}
+
+	// save output is in the form of `add <set> <entry>` lines following the
+	// `create` line
+	entries := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "add" && fields[1] == set {
+			entries = append(entries, fields[2])
+		}
+	}
+	return entries, nil
+}
+
+// Flush removes all entries from the set
+func (i *ipsetCmd) Flush(set string) error {
+	_, err := i.run("flush", set)
+	return err
+}
+
+// Swap atomically exchanges the contents of two sets
+func (i *ipsetCmd) Swap(from, to string) error {
+	_, err := i.run("swap", from, to)
+	return err
+}
+
+// Destroy removes the set
+func (i *ipsetCmd) Destroy(set string) error {
+	_, err := i.run("destroy", set)
+	return err
+}
+
+func (i *ipsetCmd) run(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(i.ctx, i.path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// ipsetFirewall keeps peers in an ipset matched by a single iptables rule.
+// Sets are shared by iptables and ip6tables, so the sets of an inet6 firewall
+// are suffixed with -v6.
+type ipsetFirewall struct {
+	ipt    IPTables
+	ips    IPSet
+	family string
+}
+
+func (f *ipsetFirewall) Setup(ctx context.Context, iface, set string) error {
+	ipt, ips := f.withContext(ctx)
+	return SetupSet(ipt, ips, iface, f.setName(set), f.family)
+}
+
+func (f *ipsetFirewall) UpdatePeers(ctx context.Context, peers []string, set string) (PeerChanges, error) {
+	_, ips := f.withContext(ctx)
+	return UpdateSetPeers(ips, peers, f.setName(set), f.family)
+}
+
+func (f *ipsetFirewall) Teardown(ctx context.Context, iface, set string) error {
+	ipt, ips := f.withContext(ctx)
+	return TeardownSet(ipt, ips, iface, f.setName(set), f.family)
+}
+
+func (f *ipsetFirewall) Check(ctx context.Context, set string) error {
+	_, ips := f.withContext(ctx)
+	_, err := ips.List(f.setName(set))
+	return err
+}
+
+func (f *ipsetFirewall) Peers(ctx context.Context, set string) ([]string, error) {
+	_, ips := f.withContext(ctx)
+	return ips.List(f.setName(set))
+}
+
+func (f *ipsetFirewall) withContext(ctx context.Context) (IPTables, IPSet) {
+	ips := f.ips
+	if c, ok := ips.(ipsetContexter); ok {
+		ips = c.withContext(ctx)
+	}
+	return &contextIPTables{ipt: f.ipt, ctx: ctx}, &contextIPSet{ips: ips, ctx: ctx}
+}
+
+func (f *ipsetFirewall) setName(set string) string {
+	if f.family == "inet6" {
+		return set + "-v6"
+	}
+	return set
+}
+
+// SetupSet creates a hash:ip set of the given family (inet or inet6) for
+// holding peers and adds the set match and deny rules to the specified
+// interface. An inet6 interface also accepts the ICMPv6 router and neighbor
+// discovery IPv6 needs to work.
+func SetupSet(ipt IPTables, ips IPSet, ipFace, set, family string) error {
+	var err error
+
+	err = ips.Create(set, "hash:ip", "family", family)
+	if err != nil {
+		return err
+	}
+
+	err = ipt.AppendUnique("filter", "INPUT", "-i", ipFace, "-m", "set", "--match-set", set, "src", "-j", "ACCEPT")
+	if err != nil {
+		return err
+	}
+	// Do not drop connections when the set is being updated
+	err = ipt.AppendUnique("filter", "INPUT", "-i", ipFace, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT")
+	if err != nil {
+		return err
+	}
+	if family == "inet6" {
+		err = acceptNeighborDiscovery(ipt, ipFace)
+		if err != nil {
+			return err
+		}
+	}
+	err = ipt.AppendUnique("filter", "INPUT", "-i", ipFace, "-j", "DROP")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TeardownSet removes the rules SetupSet added to the specified interface and
+// destroys the set (and any temporary set left behind by a failed update).
+// Rules and sets which do not exist are skipped.
+func TeardownSet(ipt IPTables, ips IPSet, ipFace, set, family string) error {
+	rulespecs := [][]string{
+		{"-i", ipFace, "-m", "set", "--match-set", set, "src", "-j", "ACCEPT"},
+		{"-i", ipFace, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+	if family == "inet6" {
+		rulespecs = append(rulespecs, neighborDiscoveryRules(ipFace)...)
+	}
+	err := deleteRules(ipt, "INPUT", append(rulespecs, []string{"-i", ipFace, "-j", "DROP"}))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{set, set + "-new"} {
+		// listing fails when the set does not exist
+		if _, err := ips.List(name); err != nil {
+			continue
+		}
+
+		err = ips.Destroy(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateSetPeers replaces the members of the specified set with the specified
+// peers. The peers are loaded into a temporary set which is then swapped with
+// the live set, so the update is atomic.
+func UpdateSetPeers(ips IPSet, peers []string, set, family string) (PeerChanges, error) {
+	changes := PeerChanges{Added: []string{}, Removed: []string{}}
+	tmp := set + "-new"
+
+	members, err := ips.List(set)
+	if err != nil {
+		return changes, err
+	}
+	current := map[string]bool{}
+	for _, member := range members {
+		current[member] = true
+	}
+
+	// Create is a no-op when a previously failed update left the set behind,
+	// so flush it as well
+	err = ips.Create(tmp, "hash:ip", "family", family)
+	if err != nil {
+		return changes, err
+	}
+	err = ips.Flush(tmp)
+	if err != nil {
+		return changes, err
+	}
+
+	desired := map[string]bool{}
+	added := []string{}
+	unchanged := 0
+	for _, peer := range peers {
+		if desired[peer] {
+			continue
+		}
+		desired[peer] = true
+
+		err := ips.Add(tmp, peer)
+		if err != nil {
+			return changes, err
+		}
+		if current[peer] {
+			unchanged++
+		} else {
+			added = append(added, peer)
+		}
+	}
+
+	err = ips.Swap(tmp, set)
+	if err != nil {
+		return changes, err
+	}
+	// the live set now holds the new peers
+	changes.Added = added
+	changes.Unchanged = unchanged
+	for _, member := range members {
+		if !desired[member] {
+			changes.Removed = append(changes.Removed, member)
+		}
+	}
+
+	return changes, ips.Destroy(tmp)
+}
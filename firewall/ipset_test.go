@@ -0,0 +1,281 @@
+package firewall
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetupSet(t *testing.T) {
+	tests := []struct {
+		name   string
+		ips    func(calls *[]string) *stubIPSet
+		family string
+		exp    error
+		calls  []string
+	}{
+		{
+			name:   "creates the set and adds the rules",
+			ips:    newRecordingStubIPSet,
+			family: "inet",
+			calls: []string{
+				"create droplan-peers hash:ip family inet",
+				"appendunique filter INPUT -i eth1 -m set --match-set droplan-peers src -j ACCEPT",
+				"appendunique filter INPUT -i eth1 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"appendunique filter INPUT -i eth1 -j DROP",
+			},
+		},
+		{
+			name:   "accepts neighbor discovery for inet6",
+			ips:    newRecordingStubIPSet,
+			family: "inet6",
+			calls: []string{
+				"create droplan-peers hash:ip family inet6",
+				"appendunique filter INPUT -i eth1 -m set --match-set droplan-peers src -j ACCEPT",
+				"appendunique filter INPUT -i eth1 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"append filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 133 -j ACCEPT",
+				"append filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 134 -j ACCEPT",
+				"append filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 135 -j ACCEPT",
+				"append filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 136 -j ACCEPT",
+				"appendunique filter INPUT -i eth1 -j DROP",
+			},
+		},
+		{
+			name: "when creating the set errors",
+			ips: func(calls *[]string) *stubIPSet {
+				s := newRecordingStubIPSet(calls)
+				s.create = func(string, string, ...string) error {
+					return errors.New("create error")
+				}
+				return s
+			},
+			family: "inet",
+			exp:    errors.New("create error"),
+			calls:  []string{},
+		},
+	}
+
+	for _, test := range tests {
+		calls := []string{}
+		out := SetupSet(newRecordingStubIPTables(&calls), test.ips(&calls), "eth1", "droplan-peers", test.family)
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Logf("want:%v", test.calls)
+			t.Logf("got:%v", calls)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestUpdateSetPeers(t *testing.T) {
+	tests := []struct {
+		name       string
+		ips        func(calls *[]string) *stubIPSet
+		peers      []string
+		exp        error
+		expChanges PeerChanges
+		calls      []string
+	}{
+		{
+			name: "swaps in a new set of peers",
+			ips: func(calls *[]string) *stubIPSet {
+				s := newRecordingStubIPSet(calls)
+				s.list = func(string) ([]string, error) {
+					return []string{"peer1", "peer2"}, nil
+				}
+				return s
+			},
+			peers:      []string{"peer2", "peer3", "peer3"},
+			expChanges: PeerChanges{Added: []string{"peer3"}, Removed: []string{"peer1"}, Unchanged: 1},
+			calls: []string{
+				"create droplan-peers-new hash:ip family inet",
+				"flush droplan-peers-new",
+				"add droplan-peers-new peer2",
+				"add droplan-peers-new peer3",
+				"swap droplan-peers-new droplan-peers",
+				"destroy droplan-peers-new",
+			},
+		},
+		{
+			name:       "swaps in an empty set when there are no peers",
+			ips:        newRecordingStubIPSet,
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			calls: []string{
+				"create droplan-peers-new hash:ip family inet",
+				"flush droplan-peers-new",
+				"swap droplan-peers-new droplan-peers",
+				"destroy droplan-peers-new",
+			},
+		},
+		{
+			name: "when listing the set errors",
+			ips: func(calls *[]string) *stubIPSet {
+				s := newRecordingStubIPSet(calls)
+				s.list = func(string) ([]string, error) {
+					return nil, errors.New("list error")
+				}
+				return s
+			},
+			exp:        errors.New("list error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			calls:      []string{},
+		},
+		{
+			name: "when adding a peer errors the live set is not swapped",
+			ips: func(calls *[]string) *stubIPSet {
+				s := newRecordingStubIPSet(calls)
+				s.add = func(string, string) error {
+					return errors.New("add error")
+				}
+				return s
+			},
+			peers:      []string{"peer1"},
+			exp:        errors.New("add error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			calls: []string{
+				"create droplan-peers-new hash:ip family inet",
+				"flush droplan-peers-new",
+			},
+		},
+		{
+			name: "when swapping errors",
+			ips: func(calls *[]string) *stubIPSet {
+				s := newRecordingStubIPSet(calls)
+				s.swap = func(string, string) error {
+					return errors.New("swap error")
+				}
+				return s
+			},
+			peers:      []string{"peer1"},
+			exp:        errors.New("swap error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			calls: []string{
+				"create droplan-peers-new hash:ip family inet",
+				"flush droplan-peers-new",
+				"add droplan-peers-new peer1",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		calls := []string{}
+		out, err := UpdateSetPeers(test.ips(&calls), test.peers, "droplan-peers", "inet")
+		if !reflect.DeepEqual(err, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(out, test.expChanges) {
+			t.Logf("want:%v", test.expChanges)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Logf("want:%v", test.calls)
+			t.Logf("got:%v", calls)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestTeardownSet(t *testing.T) {
+	calls := []string{}
+	ipt := newRecordingStubIPTables(&calls)
+	ipt.exists = func(a, b string, c ...string) (bool, error) {
+		// only the set match rule is left
+		return len(c) == 9, nil
+	}
+	ips := newRecordingStubIPSet(&calls)
+	ips.list = func(a string) ([]string, error) {
+		if a == "droplan-peers-new" {
+			return nil, errors.New("The set with the given name does not exist")
+		}
+		return []string{}, nil
+	}
+
+	err := TeardownSet(ipt, ips, "eth1", "droplan-peers", "inet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := []string{
+		"delete filter INPUT -i eth1 -m set --match-set droplan-peers src -j ACCEPT",
+		"destroy droplan-peers",
+	}
+	if !reflect.DeepEqual(calls, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", calls)
+		t.Fatal("unexpected teardown calls")
+	}
+}
+
+// newRecordingStubIPSet returns a stub which records every successful call as
+// a string in calls
+func newRecordingStubIPSet(calls *[]string) *stubIPSet {
+	record := func(parts ...string) {
+		*calls = append(*calls, strings.Join(parts, " "))
+	}
+	return &stubIPSet{
+		create: func(a, b string, c ...string) error {
+			record(append([]string{"create", a, b}, c...)...)
+			return nil
+		},
+		add: func(a, b string) error {
+			record("add", a, b)
+			return nil
+		},
+		list: func(string) ([]string, error) {
+			return []string{}, nil
+		},
+		flush: func(a string) error {
+			record("flush", a)
+			return nil
+		},
+		swap: func(a, b string) error {
+			record("swap", a, b)
+			return nil
+		},
+		destroy: func(a string) error {
+			record("destroy", a)
+			return nil
+		},
+	}
+}
+
+type stubIPSet struct {
+	create  func(string, string, ...string) error
+	add     func(string, string) error
+	list    func(string) ([]string, error)
+	flush   func(string) error
+	swap    func(string, string) error
+	destroy func(string) error
+}
+
+func (sips *stubIPSet) Create(a, b string, c ...string) error {
+	return sips.create(a, b, c...)
+}
+
+func (sips *stubIPSet) Add(a, b string) error {
+	return sips.add(a, b)
+}
+
+func (sips *stubIPSet) List(a string) ([]string, error) {
+	return sips.list(a)
+}
+
+func (sips *stubIPSet) Flush(a string) error {
+	return sips.flush(a)
+}
+
+func (sips *stubIPSet) Swap(a, b string) error {
+	return sips.swap(a, b)
+}
+
+func (sips *stubIPSet) Destroy(a string) error {
+	return sips.destroy(a)
+}
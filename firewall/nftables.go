@@ -0,0 +1,296 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// nftFamily and nftTable identify the nftables table droplan manages
+	nftFamily = "inet"
+	nftTable  = "droplan"
+)
+
+// NFTables interface for interacting with the nft command. Declare it this way
+// so that it is easy to dependency inject a mock.
+type NFTables interface {
+	// Apply runs the script as a single atomic nft transaction
+	Apply(string) error
+	// ListSet returns the elements of the named set
+	ListSet(string, string, string) ([]string, error)
+	// ListTable returns the names of the sets and chains in the table
+	ListTable(string, string) ([]string, error)
+}
+
+// nftCmd implements NFTables by running the nft binary. Commands are killed
+// when ctx is done.
+type nftCmd struct {
+	path string
+	ctx  context.Context
+}
+
+// newNFTables returns an NFTables backed by the nft binary found in the PATH
+func newNFTables() (*nftCmd, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, err
+	}
+	return &nftCmd{path: path, ctx: context.Background()}, nil
+}
+
+// withContext returns a copy of the nftCmd which runs its commands with ctx
+func (n *nftCmd) withContext(ctx context.Context) NFTables {
+	return &nftCmd{path: n.path, ctx: ctx}
+}
+
+// Apply runs the script with `nft -f -`, which applies all of the commands in
+// one transaction
+func (n *nftCmd) Apply(script string) error {
+	_, err := n.run(strings.NewReader(script), "-f", "-")
+	return err
+}
+
+// ListSet returns the elements of the set
+func (n *nftCmd) ListSet(family, table, set string) ([]string, error) {
+	out, err := n.run(nil, "list", "set", family, table, set)
+	if err != nil {
+		return nil, err
+	}
+	return parseSetElements(out), nil
+}
+
+// ListTable returns the names of the sets and chains in the table
+func (n *nftCmd) ListTable(family, table string) ([]string, error) {
+	out, err := n.run(nil, "list", "table", family, table)
+	if err != nil {
+		return nil, err
+	}
+	return parseTableNames(out), nil
+}
+
+func (n *nftCmd) run(stdin *strings.Reader, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(n.ctx, n.path, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// parseSetElements parses the `elements = { a, b, ... }` section of `nft list
+// set` output, which may span multiple lines
+func parseSetElements(out string) []string {
+	elements := []string{}
+
+	start := strings.Index(out, "elements = {")
+	if start == -1 {
+		return elements
+	}
+	out = out[start+len("elements = {"):]
+	end := strings.Index(out, "}")
+	if end == -1 {
+		return elements
+	}
+
+	for _, element := range strings.Split(out[:end], ",") {
+		element = strings.TrimSpace(element)
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// parseTableNames parses the names of the `set <name> {` and `chain <name> {`
+// lines of `nft list table` output
+func parseTableNames(out string) []string {
+	names := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && (fields[0] == "set" || fields[0] == "chain") && fields[2] == "{" {
+			names = append(names, fields[1])
+		}
+	}
+	return names
+}
+
+// nftFirewall keeps peers in a named set of the `inet droplan` table, matched
+// by a base chain hooked to input for the interface. The table holds both
+// address families, so the sets and chains of an ip6 firewall are suffixed
+// with -v6.
+type nftFirewall struct {
+	nft    NFTables
+	family string
+}
+
+func (f *nftFirewall) Setup(ctx context.Context, iface, chain string) error {
+	return SetupNFT(f.withContext(ctx), iface, f.name(chain), f.family)
+}
+
+func (f *nftFirewall) UpdatePeers(ctx context.Context, peers []string, chain string) (PeerChanges, error) {
+	return UpdateNFTPeers(f.withContext(ctx), peers, f.name(chain))
+}
+
+func (f *nftFirewall) Teardown(ctx context.Context, iface, chain string) error {
+	return TeardownNFT(f.withContext(ctx), f.name(chain), f.family)
+}
+
+func (f *nftFirewall) Check(ctx context.Context, chain string) error {
+	_, err := f.withContext(ctx).ListSet(nftFamily, nftTable, f.name(chain))
+	return err
+}
+
+func (f *nftFirewall) Peers(ctx context.Context, chain string) ([]string, error) {
+	return f.withContext(ctx).ListSet(nftFamily, nftTable, f.name(chain))
+}
+
+func (f *nftFirewall) withContext(ctx context.Context) NFTables {
+	nft := f.nft
+	if c, ok := nft.(nftContexter); ok {
+		nft = c.withContext(ctx)
+	}
+	return &contextNFTables{nft: nft, ctx: ctx}
+}
+
+func (f *nftFirewall) name(chain string) string {
+	if f.family == "ip6" {
+		return chain + "-v6"
+	}
+	return chain
+}
+
+// SetupNFT creates the droplan table with a set and input chain (both named
+// chain) that accept traffic of the given family (ip or ip6) on the specified
+// interface only from peers, along with ICMPv6 router and neighbor discovery
+// for ip6. The chain is flushed and rebuilt in the same transaction so its
+// rules always match the interface.
+//
+// The chains of both families hook input in the same inet table, so every rule
+// only matches packets of its own family; otherwise the ip chain would drop
+// all IPv6 traffic on the interface and the ip6 chain all IPv4 traffic.
+func SetupNFT(nft NFTables, ipFace, chain, family string) error {
+	t := nftFamily + " " + nftTable
+	match := fmt.Sprintf("meta nfproto %s iifname %q", nftProto(family), ipFace)
+	script := []string{
+		fmt.Sprintf("add table %s", t),
+		fmt.Sprintf("add set %s %s { type %s; }", t, chain, nftAddrType(family)),
+		fmt.Sprintf("add chain %s %s { type filter hook input priority 0; policy accept; }", t, chain),
+		fmt.Sprintf("flush chain %s %s", t, chain),
+		// Do not drop connections when the set is being updated
+		fmt.Sprintf("add rule %s %s %s ct state established,related accept", t, chain, match),
+		fmt.Sprintf("add rule %s %s %s %s saddr @%s accept", t, chain, match, family, chain),
+	}
+	if family == "ip6" {
+		// IPv6 does not work without router and neighbor discovery
+		script = append(script, fmt.Sprintf("add rule %s %s %s icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept", t, chain, match))
+	}
+	script = append(script, fmt.Sprintf("add rule %s %s %s drop", t, chain, match))
+	return nft.Apply(strings.Join(script, "\n") + "\n")
+}
+
+// TeardownNFT deletes the set and input chain (both named chain) created by
+// SetupNFT for the family. They are added first in the same transaction so
+// that deleting them never fails when they do not exist. The table is deleted
+// as well once nothing else is left in it.
+func TeardownNFT(nft NFTables, chain, family string) error {
+	t := nftFamily + " " + nftTable
+	script := []string{
+		fmt.Sprintf("add table %s", t),
+		fmt.Sprintf("add chain %s %s", t, chain),
+		fmt.Sprintf("add set %s %s { type %s; }", t, chain, nftAddrType(family)),
+		fmt.Sprintf("flush chain %s %s", t, chain),
+		fmt.Sprintf("delete chain %s %s", t, chain),
+		fmt.Sprintf("delete set %s %s", t, chain),
+	}
+
+	// listing fails when the table does not exist
+	names, err := nft.ListTable(nftFamily, nftTable)
+	if err != nil {
+		names = []string{}
+	}
+	empty := true
+	for _, name := range names {
+		if name != chain {
+			empty = false
+		}
+	}
+	if empty {
+		script = append(script, fmt.Sprintf("delete table %s", t))
+	}
+	return nft.Apply(strings.Join(script, "\n") + "\n")
+}
+
+// nftAddrType returns the set element type for addresses of the family
+func nftAddrType(family string) string {
+	if family == "ip6" {
+		return "ipv6_addr"
+	}
+	return "ipv4_addr"
+}
+
+// nftProto returns the meta nfproto value matching packets of the family
+func nftProto(family string) string {
+	if family == "ip6" {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// UpdateNFTPeers replaces the elements of the named set with the specified
+// peers in a single transaction
+func UpdateNFTPeers(nft NFTables, peers []string, set string) (PeerChanges, error) {
+	changes := PeerChanges{Added: []string{}, Removed: []string{}}
+
+	members, err := nft.ListSet(nftFamily, nftTable, set)
+	if err != nil {
+		return changes, err
+	}
+	current := map[string]bool{}
+	for _, member := range members {
+		current[member] = true
+	}
+
+	desired := map[string]bool{}
+	elements := []string{}
+	added := []string{}
+	unchanged := 0
+	for _, peer := range peers {
+		if desired[peer] {
+			continue
+		}
+		desired[peer] = true
+		elements = append(elements, peer)
+
+		if current[peer] {
+			unchanged++
+		} else {
+			added = append(added, peer)
+		}
+	}
+
+	script := fmt.Sprintf("flush set %s %s %s\n", nftFamily, nftTable, set)
+	if len(elements) > 0 {
+		script += fmt.Sprintf("add element %s %s %s { %s }\n", nftFamily, nftTable, set, strings.Join(elements, ", "))
+	}
+	err = nft.Apply(script)
+	if err != nil {
+		return changes, err
+	}
+
+	changes.Added = added
+	changes.Unchanged = unchanged
+	for _, member := range members {
+		if !desired[member] {
+			changes.Removed = append(changes.Removed, member)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,294 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSetupNFT(t *testing.T) {
+	scripts := []string{}
+	nft := &stubNFTables{
+		apply: func(a string) error {
+			scripts = append(scripts, a)
+			return nil
+		},
+	}
+
+	err := SetupNFT(nft, "eth1", "droplan-peers", "ip")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := []string{`add table inet droplan
+add set inet droplan droplan-peers { type ipv4_addr; }
+add chain inet droplan droplan-peers { type filter hook input priority 0; policy accept; }
+flush chain inet droplan droplan-peers
+add rule inet droplan droplan-peers meta nfproto ipv4 iifname "eth1" ct state established,related accept
+add rule inet droplan droplan-peers meta nfproto ipv4 iifname "eth1" ip saddr @droplan-peers accept
+add rule inet droplan droplan-peers meta nfproto ipv4 iifname "eth1" drop
+`}
+	if !reflect.DeepEqual(scripts, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", scripts)
+		t.Fatal("unexpected setup script")
+	}
+}
+
+func TestSetupNFTBothFamilies(t *testing.T) {
+	scripts := []string{}
+	nft := &stubNFTables{
+		apply: func(a string) error {
+			scripts = append(scripts, a)
+			return nil
+		},
+	}
+
+	fw4 := &nftFirewall{nft: nft, family: "ip"}
+	fw6 := &nftFirewall{nft: nft, family: "ip6"}
+	for _, fw := range []*nftFirewall{fw4, fw6} {
+		err := fw.Setup(context.Background(), "eth1", "droplan-peers")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// each chain hooks input in the shared table, so its rules must only match
+	// packets of its own family
+	exp := []string{`add table inet droplan
+add set inet droplan droplan-peers { type ipv4_addr; }
+add chain inet droplan droplan-peers { type filter hook input priority 0; policy accept; }
+flush chain inet droplan droplan-peers
+add rule inet droplan droplan-peers meta nfproto ipv4 iifname "eth1" ct state established,related accept
+add rule inet droplan droplan-peers meta nfproto ipv4 iifname "eth1" ip saddr @droplan-peers accept
+add rule inet droplan droplan-peers meta nfproto ipv4 iifname "eth1" drop
+`, `add table inet droplan
+add set inet droplan droplan-peers-v6 { type ipv6_addr; }
+add chain inet droplan droplan-peers-v6 { type filter hook input priority 0; policy accept; }
+flush chain inet droplan droplan-peers-v6
+add rule inet droplan droplan-peers-v6 meta nfproto ipv6 iifname "eth1" ct state established,related accept
+add rule inet droplan droplan-peers-v6 meta nfproto ipv6 iifname "eth1" ip6 saddr @droplan-peers-v6 accept
+add rule inet droplan droplan-peers-v6 meta nfproto ipv6 iifname "eth1" icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept
+add rule inet droplan droplan-peers-v6 meta nfproto ipv6 iifname "eth1" drop
+`}
+	if !reflect.DeepEqual(scripts, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", scripts)
+		t.Fatal("unexpected setup scripts")
+	}
+}
+
+func TestTeardownNFT(t *testing.T) {
+	teardown := `add table inet droplan
+add chain inet droplan droplan-peers-public-v6
+add set inet droplan droplan-peers-public-v6 { type ipv6_addr; }
+flush chain inet droplan droplan-peers-public-v6
+delete chain inet droplan droplan-peers-public-v6
+delete set inet droplan droplan-peers-public-v6
+`
+
+	tests := []struct {
+		name       string
+		names      []string
+		listErr    error
+		expScripts []string
+	}{
+		{
+			name:       "keeps the table of other chains",
+			names:      []string{"droplan-peers-public-v6", "droplan-peers-public", "droplan-peers-public-v6", "droplan-peers-public"},
+			expScripts: []string{teardown},
+		},
+		{
+			name:       "deletes the table once it is empty",
+			names:      []string{"droplan-peers-public-v6", "droplan-peers-public-v6"},
+			expScripts: []string{teardown + "delete table inet droplan\n"},
+		},
+		{
+			name:       "when the table does not exist",
+			listErr:    errors.New("No such file or directory"),
+			expScripts: []string{teardown + "delete table inet droplan\n"},
+		},
+	}
+
+	for _, test := range tests {
+		scripts := []string{}
+		nft := &stubNFTables{
+			apply: func(a string) error {
+				scripts = append(scripts, a)
+				return nil
+			},
+			listTable: func(a, b string) ([]string, error) {
+				if a != "inet" || b != "droplan" {
+					return nil, errors.New("bad list table args")
+				}
+				return test.names, test.listErr
+			},
+		}
+
+		err := TeardownNFT(nft, "droplan-peers-public-v6", "ip6")
+		if err != nil {
+			t.Fatalf("test case failed: %s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(scripts, test.expScripts) {
+			t.Logf("want:%v", test.expScripts)
+			t.Logf("got:%v", scripts)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestParseTableNames(t *testing.T) {
+	out := `table inet droplan {
+	set droplan-peers {
+		type ipv4_addr
+		elements = { 10.0.0.1, 10.0.0.2 }
+	}
+
+	chain droplan-peers {
+		type filter hook input priority filter; policy accept;
+		meta nfproto ipv4 iifname "eth1" drop
+	}
+}
+`
+	exp := []string{"droplan-peers", "droplan-peers"}
+	names := parseTableNames(out)
+	if !reflect.DeepEqual(names, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", names)
+		t.Fatal("unexpected table names")
+	}
+}
+
+func TestUpdateNFTPeers(t *testing.T) {
+	tests := []struct {
+		name       string
+		members    []string
+		listErr    error
+		applyErr   error
+		peers      []string
+		exp        error
+		expChanges PeerChanges
+		expScripts []string
+	}{
+		{
+			name:       "replaces the set elements",
+			members:    []string{"peer1", "peer2"},
+			peers:      []string{"peer2", "peer3", "peer3"},
+			expChanges: PeerChanges{Added: []string{"peer3"}, Removed: []string{"peer1"}, Unchanged: 1},
+			expScripts: []string{"flush set inet droplan droplan-peers\nadd element inet droplan droplan-peers { peer2, peer3 }\n"},
+		},
+		{
+			name:       "flushes the set when there are no peers",
+			members:    []string{"peer1"},
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{"peer1"}},
+			expScripts: []string{"flush set inet droplan droplan-peers\n"},
+		},
+		{
+			name:       "when listing the set errors",
+			listErr:    errors.New("list error"),
+			exp:        errors.New("list error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			expScripts: []string{},
+		},
+		{
+			name:       "when applying errors",
+			applyErr:   errors.New("apply error"),
+			peers:      []string{"peer1"},
+			exp:        errors.New("apply error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			expScripts: []string{"flush set inet droplan droplan-peers\nadd element inet droplan droplan-peers { peer1 }\n"},
+		},
+	}
+
+	for _, test := range tests {
+		scripts := []string{}
+		nft := &stubNFTables{
+			apply: func(a string) error {
+				scripts = append(scripts, a)
+				return test.applyErr
+			},
+			listSet: func(a, b, c string) ([]string, error) {
+				if a != "inet" || b != "droplan" || c != "droplan-peers" {
+					return nil, errors.New("bad list set args")
+				}
+				return test.members, test.listErr
+			},
+		}
+
+		out, err := UpdateNFTPeers(nft, test.peers, "droplan-peers")
+		if !reflect.DeepEqual(err, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(out, test.expChanges) {
+			t.Logf("want:%v", test.expChanges)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(scripts, test.expScripts) {
+			t.Logf("want:%q", test.expScripts)
+			t.Logf("got:%q", scripts)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestParseSetElements(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		exp  []string
+	}{
+		{
+			name: "empty set",
+			out: `table inet droplan {
+	set droplan-peers {
+		type ipv4_addr
+	}
+}
+`,
+			exp: []string{},
+		},
+		{
+			name: "elements across lines",
+			out: `table inet droplan {
+	set droplan-peers {
+		type ipv4_addr
+		elements = { 10.0.0.1, 10.0.0.2,
+			     10.0.0.3 }
+	}
+}
+`,
+			exp: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+	}
+
+	for _, test := range tests {
+		out := parseSetElements(test.out)
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+type stubNFTables struct {
+	apply     func(string) error
+	listSet   func(string, string, string) ([]string, error)
+	listTable func(string, string) ([]string, error)
+}
+
+func (snft *stubNFTables) Apply(a string) error {
+	return snft.apply(a)
+}
+
+func (snft *stubNFTables) ListSet(a, b, c string) ([]string, error) {
+	return snft.listSet(a, b, c)
+}
+
+func (snft *stubNFTables) ListTable(a, b string) ([]string, error) {
+	return snft.listTable(a, b)
+}
@@ -0,0 +1,160 @@
+package firewall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tam7t/droplan/discovery"
+)
+
+// Policy limits the droplets with a tag to the listed ports on the private
+// interface, instead of allowing them to reach every port
+type Policy struct {
+	Tag string `json:"tag"`
+	// Ports are written as "tcp/5432", or as a range like "udp/8000:8100"
+	Ports []string `json:"ports"`
+}
+
+// PolicyChain returns the name of the chain holding the rules of the policy
+// for tag, which the named chain jumps to
+func PolicyChain(chain, tag string) string {
+	return chain + "-" + tag
+}
+
+// ParsePort splits a policy port into its protocol and destination port (or
+// port range)
+func ParsePort(port string) (string, string, error) {
+	parts := strings.SplitN(port, "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid port %q, expected <protocol>/<port>", port)
+	}
+
+	proto, dport := parts[0], parts[1]
+	if proto != "tcp" && proto != "udp" {
+		return "", "", fmt.Errorf("invalid protocol %q in port %q, expected tcp or udp", proto, port)
+	}
+	for _, bound := range strings.SplitN(dport, ":", 2) {
+		n, err := strconv.Atoi(bound)
+		if err != nil || n < 1 || n > 65535 {
+			return "", "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return proto, dport, nil
+}
+
+// PolicyPeers returns the addresses of the peers allowed by any of the
+// policies
+func PolicyPeers(peers []discovery.Peer, policies []Policy) []string {
+	addrs := []string{}
+	for _, peer := range peers {
+		for _, policy := range policies {
+			if peer.HasTag(policy.Tag) {
+				addrs = append(addrs, peer.Address)
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// UpdatePolicies updates the named chain to jump to one chain per policy, each
+// accepting traffic from the peers with the policy's tag to the policy's ports.
+// Peers without any of the tags are not accepted at all, while the allowed
+// addresses are accepted on every port. The chains of policies which were
+// removed are deleted.
+func UpdatePolicies(ipt IPTables, peers []discovery.Peer, allowed []string, policies []Policy, chain string) (PeerChanges, error) {
+	changes := PeerChanges{Added: []string{}, Removed: []string{}}
+
+	jumps := []rule{}
+	for _, policy := range policies {
+		policyChain := PolicyChain(chain, policy.Tag)
+
+		rules := []rule{}
+		for _, peer := range peers {
+			if !peer.HasTag(policy.Tag) {
+				continue
+			}
+			for _, port := range policy.Ports {
+				proto, dport, err := ParsePort(port)
+				if err != nil {
+					return changes, err
+				}
+				rules = append(rules, rule{
+					name: peer.Address + " " + proto + "/" + dport,
+					spec: []string{"-s", peer.Address, "-p", proto, "-m", proto, "--dport", dport, "-j", "ACCEPT"},
+				})
+			}
+		}
+
+		err := newChain(ipt, policyChain)
+		if err != nil {
+			return changes, err
+		}
+		policyChanges, err := updateRules(ipt, policyChain, rules, policyRuleName)
+		if err != nil {
+			return changes, err
+		}
+		changes.Added = append(changes.Added, policyChanges.Added...)
+		changes.Removed = append(changes.Removed, policyChanges.Removed...)
+		changes.Unchanged += policyChanges.Unchanged
+
+		jumps = append(jumps, rule{name: policyChain, spec: []string{"-j", policyChain}})
+	}
+
+	rules := []rule{}
+	for _, addr := range allowed {
+		rules = append(rules, rule{name: addr, spec: []string{"-s", addr, "-j", "ACCEPT"}})
+	}
+	rules = append(rules, jumps...)
+
+	// discovered peers left in the chain from running without policies are
+	// removed along with the jumps to removed policies
+	chainChanges, err := updateRules(ipt, chain, rules, peerOrJumpFromRule)
+	if err != nil {
+		return changes, err
+	}
+	isPolicyChain := func(name string) bool {
+		return strings.HasPrefix(name, chain+"-")
+	}
+	addedJumps := 0
+	for _, added := range chainChanges.Added {
+		if isPolicyChain(added) {
+			addedJumps++
+			continue
+		}
+		changes.Added = append(changes.Added, added)
+	}
+	// only the allowed addresses are reported, not the jumps
+	changes.Unchanged += chainChanges.Unchanged - (len(jumps) - addedJumps)
+	for _, removed := range chainChanges.Removed {
+		if !isPolicyChain(removed) {
+			changes.Removed = append(changes.Removed, removed)
+			continue
+		}
+		err := deleteChain(ipt, removed)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// peerOrJumpFromRule names a `-s <peer> -j ACCEPT` rulespec by its peer and a
+// `-j <chain>` rulespec by its chain
+func peerOrJumpFromRule(spec []string) (string, bool) {
+	if peer, ok := peerFromRule(spec); ok {
+		return peer, true
+	}
+	return jumpFromRule(spec)
+}
+
+// policyRuleName names a `-s <peer> -p <proto> -m <proto> --dport <port> -j
+// ACCEPT` rulespec, as listed by iptables, by its peer and port
+func policyRuleName(spec []string) (string, bool) {
+	if len(spec) != 10 || spec[0] != "-s" || spec[2] != "-p" || spec[4] != "-m" || spec[6] != "--dport" || spec[8] != "-j" || spec[9] != "ACCEPT" {
+		return "", false
+	}
+	return trimHostPrefix(spec[1]) + " " + spec[3] + "/" + spec[7], true
+}
@@ -0,0 +1,203 @@
+package firewall
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/tam7t/droplan/discovery"
+)
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     string
+		expProto string
+		expPort  string
+		expErr   string
+	}{
+		{
+			name:     "single port",
+			port:     "tcp/5432",
+			expProto: "tcp",
+			expPort:  "5432",
+		},
+		{
+			name:     "port range",
+			port:     "udp/8000:8100",
+			expProto: "udp",
+			expPort:  "8000:8100",
+		},
+		{
+			name:   "missing protocol",
+			port:   "5432",
+			expErr: `invalid port "5432", expected <protocol>/<port>`,
+		},
+		{
+			name:   "unknown protocol",
+			port:   "icmp/8",
+			expErr: `invalid protocol "icmp" in port "icmp/8", expected tcp or udp`,
+		},
+		{
+			name:   "port out of range",
+			port:   "tcp/65536",
+			expErr: `invalid port "tcp/65536"`,
+		},
+		{
+			name:   "open ended range",
+			port:   "tcp/8000:",
+			expErr: `invalid port "tcp/8000:"`,
+		},
+	}
+
+	for _, test := range tests {
+		proto, port, err := ParsePort(test.port)
+		if (err == nil && test.expErr != "") || (err != nil && err.Error() != test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if proto != test.expProto || port != test.expPort {
+			t.Logf("want:%s %s", test.expProto, test.expPort)
+			t.Logf("got:%s %s", proto, port)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestUpdatePolicies(t *testing.T) {
+	policies := []Policy{
+		{Tag: "web", Ports: []string{"tcp/5432"}},
+		{Tag: "monitoring", Ports: []string{"tcp/9100"}},
+	}
+	peers := []discovery.Peer{
+		{Address: "10.0.0.1", Tags: []string{"web"}},
+		{Address: "10.0.0.2", Tags: []string{"web", "monitoring"}},
+		{Address: "10.0.0.3"},
+	}
+
+	tests := []struct {
+		name       string
+		ipt        func(calls *[]string) *stubIPTables
+		policies   []Policy
+		allowed    []string
+		exp        error
+		expChanges PeerChanges
+		calls      []string
+	}{
+		{
+			name: "replaces allow-all peers with policy chains",
+			ipt: listingChains(map[string][]string{
+				"droplan-peers": {"-N droplan-peers", "-A droplan-peers -s 10.0.0.3/32 -j ACCEPT"},
+			}),
+			policies: policies,
+			allowed:  []string{"192.168.1.0/24"},
+			expChanges: PeerChanges{
+				Added:   []string{"10.0.0.1 tcp/5432", "10.0.0.2 tcp/5432", "10.0.0.2 tcp/9100", "192.168.1.0/24"},
+				Removed: []string{"10.0.0.3"},
+			},
+			calls: []string{
+				"new filter droplan-peers-web",
+				"list filter droplan-peers-web",
+				"append filter droplan-peers-web -s 10.0.0.1 -p tcp -m tcp --dport 5432 -j ACCEPT",
+				"append filter droplan-peers-web -s 10.0.0.2 -p tcp -m tcp --dport 5432 -j ACCEPT",
+				"new filter droplan-peers-monitoring",
+				"list filter droplan-peers-monitoring",
+				"append filter droplan-peers-monitoring -s 10.0.0.2 -p tcp -m tcp --dport 9100 -j ACCEPT",
+				"list filter droplan-peers",
+				"append filter droplan-peers -s 192.168.1.0/24 -j ACCEPT",
+				"append filter droplan-peers -j droplan-peers-web",
+				"append filter droplan-peers -j droplan-peers-monitoring",
+				"delete filter droplan-peers -s 10.0.0.3/32 -j ACCEPT",
+			},
+		},
+		{
+			name: "removes rules and chains which are no longer allowed",
+			ipt: listingChains(map[string][]string{
+				"droplan-peers": {
+					"-N droplan-peers",
+					"-A droplan-peers -s 192.168.1.1/32 -j ACCEPT",
+					"-A droplan-peers -j droplan-peers-web",
+					"-A droplan-peers -j droplan-peers-db",
+				},
+				"droplan-peers-web": {
+					"-N droplan-peers-web",
+					"-A droplan-peers-web -s 10.0.0.1/32 -p tcp -m tcp --dport 5432 -j ACCEPT",
+					"-A droplan-peers-web -s 10.0.0.3/32 -p tcp -m tcp --dport 5432 -j ACCEPT",
+				},
+				"droplan-peers-db": {"-N droplan-peers-db"},
+			}),
+			policies: policies[:1],
+			allowed:  []string{"192.168.1.1"},
+			expChanges: PeerChanges{
+				Added:     []string{"10.0.0.2 tcp/5432"},
+				Removed:   []string{"10.0.0.3 tcp/5432"},
+				Unchanged: 2,
+			},
+			calls: []string{
+				"new filter droplan-peers-web",
+				"list filter droplan-peers-web",
+				"append filter droplan-peers-web -s 10.0.0.2 -p tcp -m tcp --dport 5432 -j ACCEPT",
+				"delete filter droplan-peers-web -s 10.0.0.3/32 -p tcp -m tcp --dport 5432 -j ACCEPT",
+				"list filter droplan-peers",
+				"delete filter droplan-peers -j droplan-peers-db",
+				"list filter droplan-peers-db",
+				"clear filter droplan-peers-db",
+				"deletechain filter droplan-peers-db",
+			},
+		},
+		{
+			name: "when creating a policy chain errors",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := newRecordingStubIPTables(calls)
+				s.newChain = func(string, string) error {
+					return errors.New("new chain error")
+				}
+				s.list = func(string, string) ([]string, error) {
+					return nil, errors.New("exit status 1: iptables: No chain/target/match by that name.\n")
+				}
+				return s
+			},
+			policies:   policies,
+			exp:        errors.New("new chain error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			calls:      []string{},
+		},
+	}
+
+	for _, test := range tests {
+		calls := []string{}
+		out, err := UpdatePolicies(test.ipt(&calls), peers, test.allowed, test.policies, "droplan-peers")
+		if !reflect.DeepEqual(err, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(out, test.expChanges) {
+			t.Logf("want:%v", test.expChanges)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Logf("want:%v", test.calls)
+			t.Logf("got:%v", calls)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+// listingChains returns a recording stub constructor whose List returns the
+// rules of each chain, with chains which are not listed being empty
+func listingChains(chains map[string][]string) func(*[]string) *stubIPTables {
+	return func(calls *[]string) *stubIPTables {
+		s := newRecordingStubIPTables(calls)
+		s.list = func(a, b string) ([]string, error) {
+			*calls = append(*calls, "list "+a+" "+b)
+			if rules, ok := chains[b]; ok {
+				return rules, nil
+			}
+			return []string{"-N " + b}, nil
+		}
+		return s
+	}
+}
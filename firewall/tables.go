@@ -0,0 +1,395 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// IPTables interface for interacting with an iptables library. Declare it this
+// way so that it is easy to dependency inject a mock.
+type IPTables interface {
+	ClearChain(string, string) error
+	Append(string, string, ...string) error
+	AppendUnique(string, string, ...string) error
+	NewChain(string, string) error
+	Delete(string, string, ...string) error
+	Exists(string, string, ...string) (bool, error)
+	List(string, string) ([]string, error)
+	DeleteChain(string, string) error
+}
+
+// Setup creates a new iptables chain for holding peers and adds the chain and
+// deny rules to the specified interface. An ip6tables interface (v6) also
+// accepts the ICMPv6 router and neighbor discovery IPv6 needs to work.
+func Setup(ipt IPTables, ipFace, chain string, v6 bool) error {
+	var err error
+
+	err = newChain(ipt, chain)
+	if err != nil {
+		return err
+	}
+
+	err = ipt.AppendUnique("filter", "INPUT", "-i", ipFace, "-j", chain)
+	if err != nil {
+		return err
+	}
+	// Do not drop connections when the `droplan-peers` chain is being updated
+	err = ipt.AppendUnique("filter", "INPUT", "-i", ipFace, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT")
+	if err != nil {
+		return err
+	}
+	if v6 {
+		err = acceptNeighborDiscovery(ipt, ipFace)
+		if err != nil {
+			return err
+		}
+	}
+	err = ipt.AppendUnique("filter", "INPUT", "-i", ipFace, "-j", "DROP")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// neighborDiscoveryRules returns the INPUT rules accepting the ICMPv6 router
+// solicitations and advertisements and neighbor solicitations and
+// advertisements (types 133 to 136) on the interface
+func neighborDiscoveryRules(ipFace string) [][]string {
+	rules := [][]string{}
+	for _, typ := range []string{"133", "134", "135", "136"} {
+		rules = append(rules, []string{"-i", ipFace, "-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", typ, "-j", "ACCEPT"})
+	}
+	return rules
+}
+
+// acceptNeighborDiscovery appends the missing neighborDiscoveryRules to INPUT.
+// They must come before the DROP rule of the interface, so a DROP rule added
+// by an earlier setup is deleted first for the caller to append it again.
+func acceptNeighborDiscovery(ipt IPTables, ipFace string) error {
+	for _, rule := range neighborDiscoveryRules(ipFace) {
+		exists, err := ipt.Exists("filter", "INPUT", rule...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		err = deleteRules(ipt, "INPUT", [][]string{{"-i", ipFace, "-j", "DROP"}})
+		if err != nil {
+			return err
+		}
+		err = ipt.Append("filter", "INPUT", rule...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrChainExists is returned when creating a chain which already exists
+var ErrChainExists = errors.New("chain already exists")
+
+// newChain creates the chain unless it already exists
+func newChain(ipt IPTables, chain string) error {
+	err := createChain(ipt, chain)
+	if errors.Is(err, ErrChainExists) {
+		return nil
+	}
+	return err
+}
+
+// createChain creates the filter chain, returning an error wrapping
+// ErrChainExists when it already exists
+func createChain(ipt IPTables, chain string) error {
+	err := ipt.NewChain("filter", chain)
+	if err == nil {
+		return nil
+	}
+
+	// iptables exits with status 1 for an existing chain, as for most other
+	// failures, and its message differs between versions and locales. Look the
+	// chain up instead of parsing the message.
+	var iptErr *iptables.Error
+	if errors.As(err, &iptErr) && iptErr.ExitStatus() != 1 {
+		return err
+	}
+	if _, listErr := ipt.List("filter", chain); listErr == nil {
+		return fmt.Errorf("%s: %w", chain, ErrChainExists)
+	}
+	return err
+}
+
+// Teardown removes the rules Setup added to the specified interface and
+// deletes the chain. Rules and chains which do not exist are skipped.
+func Teardown(ipt IPTables, ipFace, chain string, v6 bool) error {
+	rulespecs := [][]string{
+		{"-i", ipFace, "-j", chain},
+		{"-i", ipFace, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+	if v6 {
+		rulespecs = append(rulespecs, neighborDiscoveryRules(ipFace)...)
+	}
+	err := deleteRules(ipt, "INPUT", append(rulespecs, []string{"-i", ipFace, "-j", "DROP"}))
+	if err != nil {
+		return err
+	}
+
+	// listing fails when the chain does not exist
+	rules, err := ipt.List("filter", chain)
+	if err != nil {
+		return nil
+	}
+
+	// a chain must be empty before it can be deleted
+	err = ipt.ClearChain("filter", chain)
+	if err != nil {
+		return err
+	}
+	err = ipt.DeleteChain("filter", chain)
+	if err != nil {
+		return err
+	}
+
+	// policy chains are only referenced by jumps from the chain
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		if target, ok := jumpFromRule(fields[2:]); ok {
+			err = deleteChain(ipt, target)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteChain empties and deletes the filter chain if it exists
+func deleteChain(ipt IPTables, chain string) error {
+	// listing fails when the chain does not exist
+	if _, err := ipt.List("filter", chain); err != nil {
+		return nil
+	}
+
+	// a chain must be empty before it can be deleted
+	err := ipt.ClearChain("filter", chain)
+	if err != nil {
+		return err
+	}
+	return ipt.DeleteChain("filter", chain)
+}
+
+// deleteRules deletes each of the rulespecs that exist in the filter chain
+func deleteRules(ipt IPTables, chain string, rulespecs [][]string) error {
+	for _, rulespec := range rulespecs {
+		exists, err := ipt.Exists("filter", chain, rulespec...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		err = ipt.Delete("filter", chain, rulespec...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PeerChanges summarizes the rules UpdatePeers changed in a chain
+type PeerChanges struct {
+	Added     []string
+	Removed   []string
+	Unchanged int
+}
+
+// UpdatePeers updates the specified chain in iptables to contain exactly the
+// specified peers. Only the differences between the current chain and the
+// desired peers are applied, and new peers are added before stale ones are
+// removed so peer traffic is never dropped while the chain is being updated.
+func UpdatePeers(ipt IPTables, peers []string, chain string) (PeerChanges, error) {
+	rules := []rule{}
+	for _, peer := range peers {
+		rules = append(rules, rule{name: peer, spec: []string{"-s", peer, "-j", "ACCEPT"}})
+	}
+	return updateRules(ipt, chain, rules, peerFromRule)
+}
+
+// rule is a rulespec droplan keeps in a chain, along with the name its change
+// is reported by
+type rule struct {
+	name string
+	spec []string
+}
+
+// updateRules updates the chain to contain exactly the given rules, adding new
+// rules before removing stale ones. The rules currently in the chain are named
+// with describe; rules it does not recognize, and duplicates, are removed
+// without being reported, as are the policy chains of removed jumps.
+func updateRules(ipt IPTables, chain string, rules []rule, describe func([]string) (string, bool)) (PeerChanges, error) {
+	changes := PeerChanges{Added: []string{}, Removed: []string{}}
+
+	listed, err := ipt.List("filter", chain)
+	if err != nil {
+		return changes, err
+	}
+
+	// rules currently in the chain, in chain order
+	current := []rule{}
+	existing := map[string]bool{}
+	stale := [][]string{}
+	for _, line := range listed {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+
+		spec := fields[2:]
+		name, ok := describe(spec)
+		key := ruleKey(spec)
+		if !ok || existing[key] {
+			// rules droplan did not add (and duplicates) are removed as well
+			stale = append(stale, spec)
+			continue
+		}
+		current = append(current, rule{name: name, spec: spec})
+		existing[key] = true
+	}
+
+	desired := map[string]bool{}
+	for _, r := range rules {
+		key := ruleKey(r.spec)
+		if desired[key] {
+			continue
+		}
+		desired[key] = true
+
+		if existing[key] {
+			changes.Unchanged++
+			continue
+		}
+
+		err := ipt.Append("filter", chain, r.spec...)
+		if err != nil {
+			return changes, err
+		}
+		changes.Added = append(changes.Added, r.name)
+	}
+
+	for _, r := range current {
+		if desired[ruleKey(r.spec)] {
+			continue
+		}
+
+		err := ipt.Delete("filter", chain, r.spec...)
+		if err != nil {
+			return changes, err
+		}
+		changes.Removed = append(changes.Removed, r.name)
+	}
+
+	for _, spec := range stale {
+		err := ipt.Delete("filter", chain, spec...)
+		if err != nil {
+			return changes, err
+		}
+
+		// policy chains left from running with policies are only referenced by
+		// their jump, so they are deleted along with it
+		if target, ok := jumpFromRule(spec); ok && strings.HasPrefix(target, chain+"-") {
+			err = deleteChain(ipt, target)
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// ruleKey returns the rulespec as a string in which source addresses are
+// compared the same way whether or not iptables listed them with a prefix length
+func ruleKey(spec []string) string {
+	fields := make([]string, len(spec))
+	copy(fields, spec)
+	for i := 1; i < len(fields); i++ {
+		if fields[i-1] == "-s" {
+			fields[i] = trimHostPrefix(fields[i])
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// trimHostPrefix strips the /32 or /128 iptables lists single addresses with
+func trimHostPrefix(addr string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(addr, "/32"), "/128")
+}
+
+// ListPeers returns the peers accepted by the chain, including the peers of
+// the policy chains it jumps to, in chain order and without duplicates
+func ListPeers(ipt IPTables, chain string) ([]string, error) {
+	rules, err := ipt.List("filter", chain)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []string{}
+	seen := map[string]bool{}
+	add := func(peer string) {
+		if !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+
+		spec := fields[2:]
+		if peer, ok := peerFromRule(spec); ok {
+			add(peer)
+			continue
+		}
+		if target, ok := jumpFromRule(spec); ok {
+			policyPeers, err := ListPeers(ipt, target)
+			if err != nil {
+				return nil, err
+			}
+			for _, peer := range policyPeers {
+				add(peer)
+			}
+			continue
+		}
+		if name, ok := policyRuleName(spec); ok {
+			add(strings.Fields(name)[0])
+		}
+	}
+	return peers, nil
+}
+
+// peerFromRule returns the peer address accepted by a `-s <peer> -j ACCEPT`
+// rulespec as listed by iptables or ip6tables
+func peerFromRule(spec []string) (string, bool) {
+	if len(spec) != 4 || spec[0] != "-s" || spec[2] != "-j" || spec[3] != "ACCEPT" {
+		return "", false
+	}
+	return trimHostPrefix(spec[1]), true
+}
+
+// jumpFromRule returns the target chain of a `-j <chain>` rulespec
+func jumpFromRule(spec []string) (string, bool) {
+	if len(spec) != 2 || spec[0] != "-j" {
+		return "", false
+	}
+	return spec[1], true
+}
@@ -0,0 +1,718 @@
+package firewall
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestSetup(t *testing.T) {
+	count := 0
+
+	tests := []struct {
+		name string
+		ipt  IPTables
+		exp  error
+	}{
+		{
+			name: "chain exists",
+			ipt: &stubIPTables{
+				newChain: func(a, b string) error {
+					return errors.New("exit status 1: iptables: Chain already exists.\n")
+				},
+				list:         func(a, b string) ([]string, error) { return []string{"-N " + b}, nil },
+				clearChain:   func(string, string) error { return nil },
+				appendUnique: func(string, string, ...string) error { return nil },
+				append:       func(string, string, ...string) error { return nil },
+			},
+			exp: nil,
+		},
+		{
+			name: "chain exists with a localized message",
+			ipt: &stubIPTables{
+				newChain: func(a, b string) error {
+					return errors.New("exit status 1: iptables: La chaîne existe déjà.\n")
+				},
+				list:         func(a, b string) ([]string, error) { return []string{"-N " + b}, nil },
+				clearChain:   func(string, string) error { return nil },
+				appendUnique: func(string, string, ...string) error { return nil },
+				append:       func(string, string, ...string) error { return nil },
+			},
+			exp: nil,
+		},
+		{
+			name: "chain error",
+			ipt: &stubIPTables{
+				newChain: func(a, b string) error {
+					return errors.New("something bad")
+				},
+				list: func(a, b string) ([]string, error) {
+					return nil, errors.New("exit status 1: iptables: No chain/target/match by that name.\n")
+				},
+				clearChain:   func(string, string) error { return nil },
+				appendUnique: func(string, string, ...string) error { return nil },
+				append:       func(string, string, ...string) error { return nil },
+			},
+			exp: errors.New("something bad"),
+		},
+		{
+			name: "adds the droplan-peers filter",
+			ipt: &stubIPTables{
+				newChain: func(a, b string) error {
+					if a == "filter" && b == "droplan-peers" {
+						return nil
+					}
+					return errors.New("bad params")
+				},
+				clearChain:   func(string, string) error { return nil },
+				appendUnique: func(string, string, ...string) error { return nil },
+				append:       func(string, string, ...string) error { return nil },
+			},
+			exp: nil,
+		},
+		{
+			name: "when adding the chain to the interface errors",
+			ipt: &stubIPTables{
+				newChain:   func(string, string) error { return nil },
+				clearChain: func(string, string) error { return nil },
+				appendUnique: func(a, b string, c ...string) error {
+					if a == "filter" && b == "INPUT" && len(c) == 4 {
+						if c[0] == "-i" && c[1] == "eth1" && c[2] == "-j" && c[3] == "droplan-peers" {
+							return errors.New("bad add chain")
+						}
+					}
+					return nil
+				},
+				append: func(string, string, ...string) error { return nil },
+			},
+			exp: errors.New("bad add chain"),
+		},
+		{
+			name: "when adding the established connection rule errors",
+			ipt: &stubIPTables{
+				newChain:   func(string, string) error { return nil },
+				clearChain: func(string, string) error { return nil },
+				appendUnique: func(a, b string, c ...string) error {
+					if a == "filter" && b == "INPUT" && len(c) == 8 {
+						return errors.New("bad connect rule")
+					}
+					return nil
+				},
+				append: func(string, string, ...string) error { return nil },
+			},
+			exp: errors.New("bad connect rule"),
+		},
+		{
+			name: "when adding the deny rule errors",
+			ipt: &stubIPTables{
+				newChain:   func(string, string) error { return nil },
+				clearChain: func(string, string) error { return nil },
+				appendUnique: func(a, b string, c ...string) error {
+					if a == "filter" && b == "INPUT" && len(c) == 4 {
+						if c[0] == "-i" && c[1] == "eth1" && c[2] == "-j" && c[3] == "DROP" {
+							return errors.New("bad deny rule")
+						}
+					}
+					return nil
+				},
+				append: func(string, string, ...string) error { return nil },
+			},
+			exp: errors.New("bad deny rule"),
+		},
+		{
+			name: "append rules in order",
+			ipt: &stubIPTables{
+				newChain:   func(string, string) error { return nil },
+				clearChain: func(string, string) error { return nil },
+				appendUnique: func(a, b string, c ...string) error {
+					if a == "filter" && b == "INPUT" && len(c) == 4 {
+						if c[0] == "-i" && c[1] == "eth1" && c[2] == "-j" && c[3] == "DROP" {
+							return errors.New("bad deny rule")
+						}
+					}
+					return nil
+				},
+				append: func(string, string, ...string) error { return nil },
+			},
+			exp: errors.New("bad deny rule"),
+		},
+		{
+			name: "adds peer chain and drop interface",
+			ipt: &stubIPTables{
+				newChain:   func(string, string) error { return nil },
+				clearChain: func(string, string) error { return nil },
+				appendUnique: func(a, b string, c ...string) error {
+					defer func() { count++ }()
+					switch count {
+					case 0:
+						if a == "filter" && b == "INPUT" && reflect.DeepEqual(c, []string{"-i", "eth1", "-j", "droplan-peers"}) {
+							return nil
+						} else {
+							return errors.New("bad case 0")
+						}
+					case 1:
+						if a == "filter" && b == "INPUT" && reflect.DeepEqual(c, []string{"-i", "eth1", "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"}) {
+							return nil
+						} else {
+							return errors.New("bad case 1")
+						}
+					case 2:
+						if a == "filter" && b == "INPUT" && reflect.DeepEqual(c, []string{"-i", "eth1", "-j", "DROP"}) {
+							return nil
+						} else {
+							return errors.New("bad case 2")
+						}
+					default:
+						return errors.New("bad input")
+					}
+				},
+				append: func(string, string, ...string) error { return nil },
+			},
+		},
+	}
+
+	for _, test := range tests {
+		out := Setup(test.ipt, "eth1", "droplan-peers", false)
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestUpdatePeers(t *testing.T) {
+	tests := []struct {
+		name       string
+		ipt        func(calls *[]string) *stubIPTables
+		peers      []string
+		exp        error
+		expChanges PeerChanges
+		calls      []string
+	}{
+		{
+			name:       "appends peers to an empty chain",
+			ipt:        listing([]string{"-N droplan-peers"}),
+			peers:      []string{"peer1", "peer2"},
+			expChanges: PeerChanges{Added: []string{"peer1", "peer2"}, Removed: []string{}},
+			calls: []string{
+				"list filter droplan-peers",
+				"append filter droplan-peers -s peer1 -j ACCEPT",
+				"append filter droplan-peers -s peer2 -j ACCEPT",
+			},
+		},
+		{
+			name: "only applies the difference",
+			ipt: listing([]string{
+				"-N droplan-peers",
+				"-A droplan-peers -s peer1/32 -j ACCEPT",
+				"-A droplan-peers -s peer2/32 -j ACCEPT",
+			}),
+			peers:      []string{"peer2", "peer3"},
+			expChanges: PeerChanges{Added: []string{"peer3"}, Removed: []string{"peer1"}, Unchanged: 1},
+			calls: []string{
+				"list filter droplan-peers",
+				"append filter droplan-peers -s peer3 -j ACCEPT",
+				"delete filter droplan-peers -s peer1/32 -j ACCEPT",
+			},
+		},
+		{
+			name: "does nothing when the chain is up to date",
+			ipt: listing([]string{
+				"-N droplan-peers",
+				"-A droplan-peers -s peer1/32 -j ACCEPT",
+			}),
+			peers:      []string{"peer1", "peer1"},
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}, Unchanged: 1},
+			calls:      []string{"list filter droplan-peers"},
+		},
+		{
+			name: "removes duplicate and unknown rules",
+			ipt: listing([]string{
+				"-N droplan-peers",
+				"-A droplan-peers -s peer1/32 -j ACCEPT",
+				"-A droplan-peers -s peer1/32 -j ACCEPT",
+				"-A droplan-peers -j DROP",
+			}),
+			peers:      []string{"peer1"},
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}, Unchanged: 1},
+			calls: []string{
+				"list filter droplan-peers",
+				"delete filter droplan-peers -s peer1/32 -j ACCEPT",
+				"delete filter droplan-peers -j DROP",
+			},
+		},
+		{
+			name: "removes the policy chains of stale jumps",
+			ipt: listing([]string{
+				"-N droplan-peers",
+				"-A droplan-peers -s peer1/32 -j ACCEPT",
+				"-A droplan-peers -j droplan-peers-web",
+				"-A droplan-peers -j my-chain",
+			}),
+			peers:      []string{"peer1"},
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}, Unchanged: 1},
+			calls: []string{
+				"list filter droplan-peers",
+				"delete filter droplan-peers -j droplan-peers-web",
+				"list filter droplan-peers-web",
+				"clear filter droplan-peers-web",
+				"deletechain filter droplan-peers-web",
+				"delete filter droplan-peers -j my-chain",
+			},
+		},
+		{
+			name: "understands ip6tables rules",
+			ipt: listing([]string{
+				"-N droplan-peers",
+				"-A droplan-peers -s 2604:a880:800:10::b07:4001/128 -j ACCEPT",
+			}),
+			peers:      []string{"2604:a880:800:10::b07:4001"},
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}, Unchanged: 1},
+			calls:      []string{"list filter droplan-peers"},
+		},
+		{
+			name: "when listing the chain errors",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := newRecordingStubIPTables(calls)
+				s.list = func(string, string) ([]string, error) {
+					return nil, errors.New("list error")
+				}
+				return s
+			},
+			exp:        errors.New("list error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			calls:      []string{},
+		},
+		{
+			name: "when appending to the chain errors nothing is removed",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := listing([]string{"-A droplan-peers -s peer1/32 -j ACCEPT"})(calls)
+				s.append = func(string, string, ...string) error {
+					return errors.New("peer append error")
+				}
+				return s
+			},
+			peers:      []string{"peer2"},
+			exp:        errors.New("peer append error"),
+			expChanges: PeerChanges{Added: []string{}, Removed: []string{}},
+			calls:      []string{"list filter droplan-peers"},
+		},
+		{
+			name: "when deleting from the chain errors",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := listing([]string{"-A droplan-peers -s peer1/32 -j ACCEPT"})(calls)
+				s.delete = func(string, string, ...string) error {
+					return errors.New("peer delete error")
+				}
+				return s
+			},
+			peers:      []string{"peer2"},
+			exp:        errors.New("peer delete error"),
+			expChanges: PeerChanges{Added: []string{"peer2"}, Removed: []string{}},
+			calls: []string{
+				"list filter droplan-peers",
+				"append filter droplan-peers -s peer2 -j ACCEPT",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		calls := []string{}
+		out, err := UpdatePeers(test.ipt(&calls), test.peers, "droplan-peers")
+		if !reflect.DeepEqual(err, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(out, test.expChanges) {
+			t.Logf("want:%v", test.expChanges)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Logf("want:%v", test.calls)
+			t.Logf("got:%v", calls)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestCreateChain(t *testing.T) {
+	// iptables exits with status 2 for invalid arguments
+	exitErr := exec.Command("sh", "-c", "exit 2").Run().(*exec.ExitError)
+	listed := func(a, b string) ([]string, error) { return []string{"-N " + b}, nil }
+
+	tests := []struct {
+		name string
+		ipt  *stubIPTables
+		exp  error
+	}{
+		{
+			name: "new chain",
+			ipt:  &stubIPTables{newChain: func(a, b string) error { return nil }},
+		},
+		{
+			name: "existing chain",
+			ipt: &stubIPTables{
+				newChain: func(a, b string) error { return errors.New("exit status 1: iptables: Chain already exists.\n") },
+				list:     listed,
+			},
+			exp: ErrChainExists,
+		},
+		{
+			name: "invalid arguments are not looked up",
+			ipt: &stubIPTables{
+				newChain: func(a, b string) error { return &iptables.Error{ExitError: *exitErr} },
+				list:     listed,
+			},
+			exp: &iptables.Error{ExitError: *exitErr},
+		},
+	}
+
+	for _, test := range tests {
+		err := createChain(test.ipt, "droplan-peers")
+		if !errors.Is(err, test.exp) && !reflect.DeepEqual(err, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestSetupV6(t *testing.T) {
+	tests := []struct {
+		name   string
+		exists func(string, string, ...string) (bool, error)
+		exp    error
+		calls  []string
+	}{
+		{
+			name:   "accepts neighbor discovery before the deny rule",
+			exists: func(string, string, ...string) (bool, error) { return false, nil },
+			calls: []string{
+				"new filter droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -j droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 133 -j ACCEPT",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 134 -j ACCEPT",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 135 -j ACCEPT",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 136 -j ACCEPT",
+				"appendunique filter INPUT -i eth0 -j DROP",
+			},
+		},
+		{
+			name: "moves an existing deny rule after neighbor discovery",
+			exists: func(a, b string, c ...string) (bool, error) {
+				return strings.Join(c, " ") == "-i eth0 -j DROP", nil
+			},
+			calls: []string{
+				"new filter droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -j droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"delete filter INPUT -i eth0 -j DROP",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 133 -j ACCEPT",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 134 -j ACCEPT",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 135 -j ACCEPT",
+				"append filter INPUT -i eth0 -p ipv6-icmp -m icmp6 --icmpv6-type 136 -j ACCEPT",
+				"appendunique filter INPUT -i eth0 -j DROP",
+			},
+		},
+		{
+			name:   "keeps existing neighbor discovery rules",
+			exists: func(string, string, ...string) (bool, error) { return true, nil },
+			calls: []string{
+				"new filter droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -j droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"appendunique filter INPUT -i eth0 -j DROP",
+			},
+		},
+		{
+			name:   "when checking a neighbor discovery rule errors",
+			exists: func(string, string, ...string) (bool, error) { return false, errors.New("exists error") },
+			exp:    errors.New("exists error"),
+			calls: []string{
+				"new filter droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -j droplan-peers-public",
+				"appendunique filter INPUT -i eth0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		calls := []string{}
+		ipt := newRecordingStubIPTables(&calls)
+		deleted := map[string]bool{}
+		ipt.exists = func(a, b string, c ...string) (bool, error) {
+			if deleted[strings.Join(c, " ")] {
+				return false, nil
+			}
+			return test.exists(a, b, c...)
+		}
+		ipt.delete = func(a, b string, c ...string) error {
+			deleted[strings.Join(c, " ")] = true
+			calls = append(calls, strings.Join(append([]string{"delete", a, b}, c...), " "))
+			return nil
+		}
+		out := Setup(ipt, "eth0", "droplan-peers-public", true)
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Logf("want:%v", test.calls)
+			t.Logf("got:%v", calls)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	tests := []struct {
+		name  string
+		ipt   func(calls *[]string) *stubIPTables
+		v6    bool
+		exp   error
+		calls []string
+	}{
+		{
+			name: "removes the rules and chain",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := newRecordingStubIPTables(calls)
+				s.exists = func(string, string, ...string) (bool, error) { return true, nil }
+				return s
+			},
+			calls: []string{
+				"delete filter INPUT -i eth1 -j droplan-peers",
+				"delete filter INPUT -i eth1 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"delete filter INPUT -i eth1 -j DROP",
+				"list filter droplan-peers",
+				"clear filter droplan-peers",
+				"deletechain filter droplan-peers",
+			},
+		},
+		{
+			name: "removes the neighbor discovery rules of ip6tables",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := newRecordingStubIPTables(calls)
+				s.exists = func(string, string, ...string) (bool, error) { return true, nil }
+				return s
+			},
+			v6: true,
+			calls: []string{
+				"delete filter INPUT -i eth1 -j droplan-peers",
+				"delete filter INPUT -i eth1 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"delete filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 133 -j ACCEPT",
+				"delete filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 134 -j ACCEPT",
+				"delete filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 135 -j ACCEPT",
+				"delete filter INPUT -i eth1 -p ipv6-icmp -m icmp6 --icmpv6-type 136 -j ACCEPT",
+				"delete filter INPUT -i eth1 -j DROP",
+				"list filter droplan-peers",
+				"clear filter droplan-peers",
+				"deletechain filter droplan-peers",
+			},
+		},
+		{
+			name: "removes the policy chains the chain jumps to",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := listing([]string{
+					"-N droplan-peers",
+					"-A droplan-peers -j droplan-peers-web",
+				})(calls)
+				s.exists = func(string, string, ...string) (bool, error) { return true, nil }
+				return s
+			},
+			calls: []string{
+				"delete filter INPUT -i eth1 -j droplan-peers",
+				"delete filter INPUT -i eth1 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+				"delete filter INPUT -i eth1 -j DROP",
+				"list filter droplan-peers",
+				"clear filter droplan-peers",
+				"deletechain filter droplan-peers",
+				"list filter droplan-peers-web",
+				"clear filter droplan-peers-web",
+				"deletechain filter droplan-peers-web",
+			},
+		},
+		{
+			name: "skips rules and chains which do not exist",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := newRecordingStubIPTables(calls)
+				s.list = func(string, string) ([]string, error) {
+					return nil, errors.New("exit status 1: iptables: No chain/target/match by that name.\n")
+				}
+				return s
+			},
+			calls: []string{},
+		},
+		{
+			name: "when checking a rule errors",
+			ipt: func(calls *[]string) *stubIPTables {
+				s := newRecordingStubIPTables(calls)
+				s.exists = func(string, string, ...string) (bool, error) {
+					return false, errors.New("exists error")
+				}
+				return s
+			},
+			exp:   errors.New("exists error"),
+			calls: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		calls := []string{}
+		out := Teardown(test.ipt(&calls), "eth1", "droplan-peers", test.v6)
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Logf("want:%v", test.calls)
+			t.Logf("got:%v", calls)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestListPeers(t *testing.T) {
+	ipt := listingChains(map[string][]string{
+		"droplan-peers": {
+			"-N droplan-peers",
+			"-A droplan-peers -s 10.0.0.1/32 -j ACCEPT",
+			"-A droplan-peers -s 10.8.0.0/24 -j ACCEPT",
+			"-A droplan-peers -j droplan-peers-web",
+		},
+		"droplan-peers-web": {
+			"-N droplan-peers-web",
+			"-A droplan-peers-web -s 10.0.0.1/32 -p tcp -m tcp --dport 5432 -j ACCEPT",
+			"-A droplan-peers-web -s 10.0.0.2/32 -p tcp -m tcp --dport 5432 -j ACCEPT",
+		},
+	})(&[]string{})
+
+	out, err := ListPeers(ipt, "droplan-peers")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []string{"10.0.0.1", "10.8.0.0/24", "10.0.0.2"}
+	if !reflect.DeepEqual(out, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out)
+		t.Fatal("unexpected peers")
+	}
+}
+
+// listing returns a recording stub constructor whose List returns rules
+func listing(rules []string) func(*[]string) *stubIPTables {
+	return func(calls *[]string) *stubIPTables {
+		s := newRecordingStubIPTables(calls)
+		s.list = func(a, b string) ([]string, error) {
+			*calls = append(*calls, "list "+a+" "+b)
+			return rules, nil
+		}
+		return s
+	}
+}
+
+func newStubIPTables() *stubIPTables {
+	return &stubIPTables{
+		newChain:     func(string, string) error { return nil },
+		clearChain:   func(string, string) error { return nil },
+		appendUnique: func(string, string, ...string) error { return nil },
+		append:       func(string, string, ...string) error { return nil },
+		delete:       func(string, string, ...string) error { return nil },
+		exists:       func(string, string, ...string) (bool, error) { return false, nil },
+		list:         func(string, string) ([]string, error) { return []string{}, nil },
+		deleteChain:  func(string, string) error { return nil },
+	}
+}
+
+// newRecordingStubIPTables returns a stub which records every successful call
+// as a string in calls
+func newRecordingStubIPTables(calls *[]string) *stubIPTables {
+	record := func(parts ...string) {
+		*calls = append(*calls, strings.Join(parts, " "))
+	}
+	return &stubIPTables{
+		newChain: func(a, b string) error {
+			record("new", a, b)
+			return nil
+		},
+		clearChain: func(a, b string) error {
+			record("clear", a, b)
+			return nil
+		},
+		appendUnique: func(a, b string, c ...string) error {
+			record(append([]string{"appendunique", a, b}, c...)...)
+			return nil
+		},
+		append: func(a, b string, c ...string) error {
+			record(append([]string{"append", a, b}, c...)...)
+			return nil
+		},
+		delete: func(a, b string, c ...string) error {
+			record(append([]string{"delete", a, b}, c...)...)
+			return nil
+		},
+		exists: func(a, b string, c ...string) (bool, error) {
+			return false, nil
+		},
+		list: func(a, b string) ([]string, error) {
+			record("list", a, b)
+			return []string{}, nil
+		},
+		deleteChain: func(a, b string) error {
+			record("deletechain", a, b)
+			return nil
+		},
+	}
+}
+
+type stubIPTables struct {
+	newChain     func(string, string) error
+	clearChain   func(string, string) error
+	appendUnique func(string, string, ...string) error
+	append       func(string, string, ...string) error
+	delete       func(string, string, ...string) error
+	exists       func(string, string, ...string) (bool, error)
+	list         func(string, string) ([]string, error)
+	deleteChain  func(string, string) error
+}
+
+func (sipt *stubIPTables) ClearChain(a, b string) error {
+	return sipt.clearChain(a, b)
+}
+
+func (sipt *stubIPTables) Append(a, b string, c ...string) error {
+	return sipt.append(a, b, c...)
+}
+
+func (sipt *stubIPTables) AppendUnique(a, b string, c ...string) error {
+	return sipt.appendUnique(a, b, c...)
+}
+
+func (sipt *stubIPTables) NewChain(a, b string) error {
+	return sipt.newChain(a, b)
+}
+
+func (sipt *stubIPTables) Delete(a, b string, c ...string) error {
+	return sipt.delete(a, b, c...)
+}
+
+func (sipt *stubIPTables) Exists(a, b string, c ...string) (bool, error) {
+	return sipt.exists(a, b, c...)
+}
+
+func (sipt *stubIPTables) List(a, b string) ([]string, error) {
+	return sipt.list(a, b)
+}
+
+func (sipt *stubIPTables) DeleteChain(a, b string) error {
+	return sipt.deleteChain(a, b)
+}
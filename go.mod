@@ -0,0 +1,16 @@
+module github.com/tam7t/droplan
+
+go 1.22
+
+require (
+	github.com/coreos/go-iptables v0.0.0-20160907220151-5463fbac3bcc
+	github.com/digitalocean/go-metadata v0.0.0-20160922022214-a6cf11fb1bf5
+	github.com/digitalocean/godo v0.0.0-20160909171455-2ff8a02a86cd
+	golang.org/x/oauth2 v0.0.0-20161006214720-1e695b1c8feb
+)
+
+require (
+	github.com/google/go-querystring v0.0.0-20160311012012-9235644dd9e5 // indirect
+	github.com/tent/http-link-go v0.0.0-20130702225549-ac974c61c2f9 // indirect
+	golang.org/x/net v0.0.0-20161013031131-8b4af36cd21a // indirect
+)
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// healthz responds while the process is alive
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz responds with 503 Service Unavailable and the reason while ready
+// returns an error. Ready is given the context of the request.
+func readyz(ready func(context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := ready(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "ready",
+			expCode: http.StatusOK,
+			expBody: "ok\n",
+		},
+		{
+			name:    "not ready",
+			err:     errors.New("no successful reconcile yet"),
+			expCode: http.StatusServiceUnavailable,
+			expBody: "no successful reconcile yet\n",
+		},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		readyz(func(context.Context) error { return test.err })(rec, httptest.NewRequest("GET", "/readyz", nil))
+		if rec.Code != test.expCode || rec.Body.String() != test.expBody {
+			t.Logf("want:%d %q", test.expCode, test.expBody)
+			t.Logf("got:%d %q", rec.Code, rec.Body.String())
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package ctxrun
+
+import "context"
+
+// Run calls f unless the context is already done, and returns the context's
+// error if it is done before f returns. f is left to finish in the background
+// then, so it is meant for calls which can not be interrupted and are bounded
+// some other way.
+func Run[T any](ctx context.Context, f func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := f()
+		done <- result{v, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// RunErr is Run for calls which only return an error
+func RunErr(ctx context.Context, f func() error) error {
+	_, err := Run(ctx, func() (struct{}, error) {
+		return struct{}{}, f()
+	})
+	return err
+}
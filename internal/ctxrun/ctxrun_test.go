@@ -0,0 +1,63 @@
+package ctxrun
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelExpired()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		f      func() ([]string, error)
+		exp    []string
+		expErr error
+	}{
+		{
+			name: "command finishes",
+			ctx:  context.Background(),
+			f:    func() ([]string, error) { return []string{"peer1"}, nil },
+			exp:  []string{"peer1"},
+		},
+		{
+			name:   "command fails",
+			ctx:    context.Background(),
+			f:      func() ([]string, error) { return nil, errors.New("exit status 1") },
+			expErr: errors.New("exit status 1"),
+		},
+		{
+			name:   "context already done",
+			ctx:    canceled,
+			f:      func() ([]string, error) { return []string{"peer1"}, nil },
+			expErr: context.Canceled,
+		},
+		{
+			name: "command outlives the context",
+			ctx:  expired,
+			f: func() ([]string, error) {
+				<-block
+				return []string{"peer1"}, nil
+			},
+			expErr: context.DeadlineExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := Run(test.ctx, test.f)
+		if len(got) != len(test.exp) || (err == nil) != (test.expErr == nil) || (err != nil && err.Error() != test.expErr.Error()) {
+			t.Logf("want:%v %v", test.exp, test.expErr)
+			t.Logf("got:%v %v", got, err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
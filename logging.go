@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/tam7t/droplan/reconcile"
+)
+
+// setupLogging configures the default logger. The "text" format keeps the
+// standard log output with the fields appended as key=value pairs, while the
+// "json" format writes one JSON object per line to w.
+func setupLogging(w io.Writer, format, level string) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", level)
+	}
+
+	switch format {
+	case "text":
+		slog.SetLogLoggerLevel(lvl)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl})))
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return nil
+}
+
+// errAttrs returns the fields describing err, including the config key when
+// it is a ConfigError
+func errAttrs(err error) []any {
+	attrs := []any{"err", err}
+	var cfgErr *reconcile.ConfigError
+	if errors.As(err, &cfgErr) {
+		attrs = append(attrs, "key", cfgErr.Key)
+	}
+	return attrs
+}
+
+func failIfErr(err error) {
+	if err != nil {
+		fatal("Failed", errAttrs(err)...)
+	}
+}
+
+// fatal logs the message at the error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
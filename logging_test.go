@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/tam7t/droplan/reconcile"
+)
+
+func TestSetupLogging(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		level  string
+		exp    string
+		expErr string
+	}{
+		{
+			name:   "json at the info level",
+			format: "json",
+			level:  "info",
+			exp:    `{"level":"WARN","msg":"No droplets listed in region","region":"nyc1"}` + "\n",
+		},
+		{
+			name:   "json at the error level",
+			format: "json",
+			level:  "ERROR",
+			exp:    "",
+		},
+		{
+			name:   "unknown format",
+			format: "xml",
+			level:  "info",
+			expErr: `unknown log format "xml", expected text or json`,
+		},
+		{
+			name:   "unknown level",
+			format: "json",
+			level:  "verbose",
+			expErr: `invalid log level "verbose", expected debug, info, warn or error`,
+		},
+	}
+
+	defer slog.SetDefault(slog.Default())
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := setupLogging(out, test.format, test.level)
+		if (err == nil && test.expErr != "") || (err != nil && err.Error() != test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if err != nil {
+			continue
+		}
+
+		// drop the time so the output can be compared
+		slog.SetDefault(slog.New(withoutTime(slog.Default().Handler())))
+		slog.Debug("Listed droplets", "droplets", 2)
+		slog.Warn("No droplets listed in region", "region", "nyc1")
+		if out.String() != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", out.String())
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestErrAttrs(t *testing.T) {
+	err := fmt.Errorf("config droplan.json: %w", &reconcile.ConfigError{Key: "interval", Err: fmt.Errorf("must be positive")})
+	out := fmt.Sprint(errAttrs(err))
+	exp := "[err config droplan.json: interval: must be positive key interval]"
+	if out != exp {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out)
+		t.Fatal("unexpected error fields")
+	}
+}
+
+// timelessHandler zeroes the time of each record, which handlers then leave
+// out
+type timelessHandler struct {
+	slog.Handler
+}
+
+func withoutTime(h slog.Handler) slog.Handler {
+	return timelessHandler{h}
+}
+
+func (h timelessHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.Time = time.Time{}
+	return h.Handler.Handle(ctx, r)
+}
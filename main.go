@@ -1,110 +1,123 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/coreos/go-iptables/iptables"
-	"github.com/digitalocean/go-metadata"
-	"github.com/digitalocean/godo"
-	"golang.org/x/oauth2"
+	"github.com/tam7t/droplan/reconcile"
 )
 
 var appVersion string
 
 func main() {
 	version := flag.Bool("version", false, "Print the version and exit.")
+	configPath := flag.String("config", "", "Path to a JSON config file.")
+	dryRun := flag.Bool("dry-run", false, "Print the firewall commands that would be run instead of running them.")
+	backend := flag.String("backend", "auto", "Firewall backend used to hold peers: auto, iptables, ipset or nftables.")
+	privateIface := flag.String("private-iface", "", "Name of the private interface, instead of finding it from metadata.")
+	publicIface := flag.String("public-iface", "", "Name of the public interface, instead of finding it from metadata.")
+	logFormat := flag.String("log-format", "text", "Log format: text or json.")
+	logLevel := flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error.")
+	force := flag.Bool("force", false, "Apply peer lists which are empty or shrink by more than max_shrink percent.")
 	flag.Parse()
 	if *version {
-		log.Printf(appVersion)
+		log.Print(appVersion)
 		os.Exit(0)
 	}
-
-	accessToken := os.Getenv("DO_KEY")
-	if accessToken == "" {
-		log.Fatal("Usage: DO_KEY environment variable must be set.")
+	failIfErr(setupLogging(os.Stderr, *logFormat, *logLevel))
+
+	// the config file is overridden by environment variables, which are in
+	// turn overridden by flags
+	cfg := reconcile.DefaultConfig()
+	var err error
+	if *configPath != "" {
+		cfg, err = reconcile.LoadConfig(*configPath)
+		failIfErr(err)
 	}
-
-	peerTag := os.Getenv("DO_TAG")
-
-	// PUBLIC=true will tell us to block traffic on the public interface
-	public := os.Getenv("PUBLIC")
-
-	// setup dependencies
-	oauthClient := oauth2.NewClient(oauth2.NoContext, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
-	apiClient := godo.NewClient(oauthClient)
-	metaClient := metadata.NewClient()
-	ipt, err := iptables.New()
-	failIfErr(err)
-
-	// collect needed metadata from metadata service
-	region, err := metaClient.Region()
-	failIfErr(err)
-	mData, err := metaClient.Metadata()
-	failIfErr(err)
-
-	// collect list of all droplets
-	var drops []godo.Droplet
-	if peerTag != "" {
-		drops, err = DropletListTags(apiClient.Droplets, peerTag)
-	} else {
-		drops, err = DropletList(apiClient.Droplets)
+	failIfErr(cfg.ApplyEnv(os.Getenv))
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "backend":
+			cfg.Backend = *backend
+		case "private-iface":
+			cfg.Interfaces.Private = *privateIface
+		case "public-iface":
+			cfg.Interfaces.Public = *publicIface
+		}
+	})
+
+	var jitter *float64
+	var listen *string
+	var readyIntervals *int
+	if flag.Arg(0) == "daemon" {
+		fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+		interval := fs.Duration("interval", cfg.Interval.Duration, "Time between reconcile runs.")
+		jitter = fs.Float64("jitter", 0.1, "Maximum random delay added to each interval, as a fraction of the interval.")
+		listen = fs.String("listen", "", "Address to serve /metrics, /healthz and /readyz on, e.g. :9710. Disabled when empty.")
+		readyIntervals = fs.Int("ready-intervals", 3, "Number of intervals since the last successful reconcile after which /readyz fails.")
+		fs.Parse(flag.Args()[1:])
+		cfg.Interval = reconcile.Duration{Duration: *interval}
 	}
-	failIfErr(err)
-
-	// collect local network interface information
-	ifaces, err := net.Interfaces()
-	failIfErr(err)
-
-	pubAddr, err := PublicAddress(mData)
-	failIfErr(err)
+	failIfErr(cfg.Validate())
 
-	if public == "true" {
-		publicPeers := PublicDroplets(drops)
-
-		// find public iface name
-		iface, err := FindInterfaceName(ifaces, pubAddr)
-		failIfErr(err)
-
-		// setup droplan-peers-public chain for public interface
-		err = Setup(ipt, iface, "droplan-peers-public")
-		failIfErr(err)
-
-		// update droplan-peers-public
-		err = UpdatePeers(ipt, publicPeers, "droplan-peers-public")
-		failIfErr(err)
-		log.Printf("Added %d peers to droplan-peers-public", len(publicPeers))
+	// in a dry run the firewall commands are printed to stdout
+	opts := []reconcile.Option{reconcile.WithForce(*force)}
+	if *dryRun {
+		opts = append(opts, reconcile.WithDryRun(os.Stdout))
 	}
-
-	privAddr, err := PrivateAddress(mData)
-	failIfErr(err)
-
-	privatePeers, ok := SortDroplets(drops)[region]
-	if !ok {
-		log.Printf("No droplets listed in region [%s]", region)
+	if jitter != nil {
+		opts = append(opts, reconcile.WithJitter(*jitter))
 	}
 
-	// find private iface name
-	iface, err := FindInterfaceName(ifaces, privAddr)
-	if public != "" && err != nil && err.Error() == "no private interfaces" {
-		os.Exit(0)
+	if flag.Arg(0) != "uninstall" && cfg.Token == "" {
+		fatal("Usage: DO_KEY environment variable or token config must be set.")
 	}
-	failIfErr(err)
 
-	// setup droplan-peers chain for private interface
-	err = Setup(ipt, iface, "droplan-peers")
+	r, err := reconcile.New(cfg, opts...)
 	failIfErr(err)
 
-	// update droplan-peers
-	err = UpdatePeers(ipt, privatePeers, "droplan-peers")
-	failIfErr(err)
-	log.Printf("Added %d peers to droplan-peers", len(privatePeers))
-}
-
-func failIfErr(err error) {
-	if err != nil {
-		log.Fatal(err)
+	// a signal abandons the current run
+	ctx, stop := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		slog.Info("Shutting down", "signal", sig.String())
+		stop()
+	}()
+
+	switch flag.Arg(0) {
+	case "uninstall":
+		failIfErr(r.Uninstall(ctx))
+	case "":
+		failIfErr(r.Reconcile(ctx))
+	case "daemon":
+		if *listen != "" {
+			ln, err := net.Listen("tcp", *listen)
+			failIfErr(err)
+			maxAge := time.Duration(*readyIntervals) * cfg.Interval.Duration
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", r.Metrics())
+			mux.HandleFunc("/healthz", healthz)
+			mux.Handle("/readyz", readyz(func(ctx context.Context) error {
+				return r.Ready(ctx, time.Now(), maxAge)
+			}))
+			go func() {
+				slog.Info("Serving metrics and health checks", "addr", ln.Addr().String())
+				failIfErr(http.Serve(ln, mux))
+			}()
+		}
+
+		r.Run(ctx)
+	default:
+		fatal("Usage: unknown command", "command", flag.Arg(0))
 	}
 }
@@ -0,0 +1,399 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tam7t/droplan/discovery"
+	"github.com/tam7t/droplan/firewall"
+)
+
+// Config holds the settings droplan runs with. It is loaded from an optional
+// JSON config file, then overridden by environment variables and flags.
+type Config struct {
+	// Token is the DigitalOcean API token (DO_KEY)
+	Token string `json:"token"`
+	// Tags limits peers to droplets with these tags (DO_TAG, comma separated)
+	Tags []string `json:"tags"`
+	// TagMode selects droplets with "any" or "all" of the tags (DO_TAG_MODE)
+	TagMode string `json:"tag_mode"`
+	// Grouping selects private peers sharing the droplet's "vpc" or "region"
+	Grouping string `json:"grouping"`
+	// Public also filters the public interface (PUBLIC)
+	Public bool `json:"public"`
+	// Interval is the time between reconcile runs in daemon mode (DO_INTERVAL)
+	Interval Duration `json:"interval"`
+	// APIRetryBudget is the longest time spent waiting to retry each failed
+	// DigitalOcean API request, counting every page of a listing separately
+	APIRetryBudget Duration `json:"api_retry_budget"`
+	// Timeout is the longest a single run may take before it is abandoned
+	// (DO_TIMEOUT)
+	Timeout Duration `json:"timeout"`
+	// OperationTimeout is the longest each DigitalOcean API request,
+	// metadata lookup and firewall update may take (DO_OPERATION_TIMEOUT)
+	OperationTimeout Duration `json:"operation_timeout"`
+	// MaxShrink is the largest percentage of peers a chain may lose in one
+	// update without -force
+	MaxShrink int `json:"max_shrink"`
+	// Backend is the firewall backend (-backend)
+	Backend string `json:"backend"`
+	// Interfaces overrides the interface names found from metadata
+	Interfaces InterfacesConfig `json:"interfaces"`
+	// Chains names the chains (or sets) holding peers
+	Chains ChainsConfig `json:"chains"`
+	// Policies limits private peers to ports by tag (iptables backend only)
+	Policies []firewall.Policy `json:"policies"`
+	// Allow lists addresses and CIDRs which are always peers
+	Allow AllowConfig `json:"allow"`
+}
+
+// InterfacesConfig names the private and public network interfaces. Empty
+// names are looked up from metadata.
+type InterfacesConfig struct {
+	Private string `json:"private"`
+	Public  string `json:"public"`
+}
+
+// ChainsConfig names the chains (or sets) holding the private and public peers
+type ChainsConfig struct {
+	Private string `json:"private"`
+	Public  string `json:"public"`
+}
+
+// AllowConfig lists the static addresses and CIDRs allowed on the private and
+// public interfaces alongside the discovered peers
+type AllowConfig struct {
+	Private []string `json:"private"`
+	Public  []string `json:"public"`
+}
+
+// Duration is a time.Duration which is read from JSON as either a duration
+// string ("5m") or a number of seconds
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var secs int
+	if err := json.Unmarshal(data, &secs); err == nil {
+		d.Duration = time.Duration(secs) * time.Second
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return &durationError{data: data, err: fmt.Errorf("invalid duration %s", data)}
+	}
+	dur, err := parseDuration(s)
+	if err != nil {
+		return &durationError{data: data, err: err}
+	}
+	d.Duration = dur
+	return nil
+}
+
+// durationError is returned for a JSON value which is not a duration. The
+// decoder does not say which key held it, so the value is kept for
+// decodeError to look the key up.
+type durationError struct {
+	data []byte
+	err  error
+}
+
+func (e *durationError) Error() string {
+	return e.err.Error()
+}
+
+// durationKeys lists the config keys holding a Duration
+var durationKeys = []string{"interval", "api_retry_budget", "timeout", "operation_timeout"}
+
+// parseDuration parses a duration string or a number of seconds
+func parseDuration(s string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return dur, nil
+}
+
+// ConfigError points at the config key that could not be loaded or validated
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+// DefaultConfig returns the config used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		Tags:             []string{},
+		TagMode:          discovery.TagModeAny,
+		Grouping:         discovery.GroupingVPC,
+		Interval:         Duration{5 * time.Minute},
+		APIRetryBudget:   Duration{2 * time.Minute},
+		Timeout:          Duration{4 * time.Minute},
+		OperationTimeout: Duration{30 * time.Second},
+		MaxShrink:        50,
+		Backend:          "auto",
+		Chains: ChainsConfig{
+			Private: "droplan-peers",
+			Public:  "droplan-peers-public",
+		},
+	}
+}
+
+// LoadConfig reads the JSON config file at path on top of the defaults
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("config %s: %w", path, decodeError(data, err))
+	}
+	return cfg, nil
+}
+
+// unknownField matches the error returned for keys which are not part of the
+// config
+var unknownField = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// decodeError converts errors decoding the JSON data to ConfigErrors where the
+// key is known
+func decodeError(data []byte, err error) error {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		if e.Field != "" {
+			return &ConfigError{Key: e.Field, Err: fmt.Errorf("can not use %s as %s", e.Value, e.Type)}
+		}
+	case *durationError:
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(data, &fields) == nil {
+			for _, key := range durationKeys {
+				if bytes.Equal(fields[key], e.data) {
+					return &ConfigError{Key: key, Err: e}
+				}
+			}
+		}
+	}
+
+	if m := unknownField.FindStringSubmatch(err.Error()); m != nil {
+		return &ConfigError{Key: m[1], Err: fmt.Errorf("unknown key")}
+	}
+	return err
+}
+
+// ApplyEnv overrides the config with the DO_KEY, DO_TAG, DO_TAG_MODE, PUBLIC,
+// DO_INTERVAL, DO_TIMEOUT and DO_OPERATION_TIMEOUT environment variables when
+// they are set
+func (c *Config) ApplyEnv(getenv func(string) string) error {
+	if token := getenv("DO_KEY"); token != "" {
+		c.Token = token
+	}
+	if tags := getenv("DO_TAG"); tags != "" {
+		c.Tags = []string{}
+		for _, tag := range strings.Split(tags, ",") {
+			c.Tags = append(c.Tags, strings.TrimSpace(tag))
+		}
+	}
+	if mode := getenv("DO_TAG_MODE"); mode != "" {
+		c.TagMode = mode
+	}
+	if public := getenv("PUBLIC"); public != "" {
+		// PUBLIC=true will tell us to block traffic on the public interface
+		c.Public = public == "true"
+	}
+	if interval := getenv("DO_INTERVAL"); interval != "" {
+		dur, err := parseDuration(interval)
+		if err != nil {
+			return &ConfigError{Key: "DO_INTERVAL", Err: err}
+		}
+		c.Interval = Duration{dur}
+	}
+	if timeout := getenv("DO_TIMEOUT"); timeout != "" {
+		dur, err := parseDuration(timeout)
+		if err != nil {
+			return &ConfigError{Key: "DO_TIMEOUT", Err: err}
+		}
+		c.Timeout = Duration{dur}
+	}
+	if timeout := getenv("DO_OPERATION_TIMEOUT"); timeout != "" {
+		dur, err := parseDuration(timeout)
+		if err != nil {
+			return &ConfigError{Key: "DO_OPERATION_TIMEOUT", Err: err}
+		}
+		c.OperationTimeout = Duration{dur}
+	}
+	return nil
+}
+
+// chainName matches names usable as both iptables chains and ipset/nftables
+// sets. The length leaves room for the -new and -v6 suffixes droplan adds.
+var chainName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,24}$`)
+
+// policyTag matches the tags DigitalOcean allows
+var policyTag = regexp.MustCompile(`^[A-Za-z0-9:_-]+$`)
+
+// maxChainLen is the longest chain name iptables accepts
+const maxChainLen = 28
+
+// Validate checks the config for values droplan can not run with
+func (c *Config) Validate() error {
+	if c.Interval.Duration <= 0 {
+		return &ConfigError{Key: "interval", Err: fmt.Errorf("must be positive, got %s", c.Interval)}
+	}
+	if c.APIRetryBudget.Duration < 0 {
+		return &ConfigError{Key: "api_retry_budget", Err: fmt.Errorf("must not be negative, got %s", c.APIRetryBudget)}
+	}
+	if c.Timeout.Duration <= 0 {
+		return &ConfigError{Key: "timeout", Err: fmt.Errorf("must be positive, got %s", c.Timeout)}
+	}
+	if c.OperationTimeout.Duration <= 0 {
+		return &ConfigError{Key: "operation_timeout", Err: fmt.Errorf("must be positive, got %s", c.OperationTimeout)}
+	}
+	if c.OperationTimeout.Duration > c.Timeout.Duration {
+		return &ConfigError{Key: "operation_timeout", Err: fmt.Errorf("must not be longer than timeout (%s), got %s", c.Timeout, c.OperationTimeout)}
+	}
+	if c.MaxShrink < 0 || c.MaxShrink > 100 {
+		return &ConfigError{Key: "max_shrink", Err: fmt.Errorf("must be a percentage between 0 and 100, got %d", c.MaxShrink)}
+	}
+
+	switch c.Backend {
+	case "auto", "iptables", "ipset", "nftables":
+	default:
+		return &ConfigError{Key: "backend", Err: fmt.Errorf("unknown firewall backend %q", c.Backend)}
+	}
+
+	switch c.TagMode {
+	case discovery.TagModeAny, discovery.TagModeAll:
+	default:
+		return &ConfigError{Key: "tag_mode", Err: fmt.Errorf("must be %q or %q, got %q", discovery.TagModeAny, discovery.TagModeAll, c.TagMode)}
+	}
+	switch c.Grouping {
+	case discovery.GroupingVPC, discovery.GroupingRegion:
+	default:
+		return &ConfigError{Key: "grouping", Err: fmt.Errorf("must be %q or %q, got %q", discovery.GroupingVPC, discovery.GroupingRegion, c.Grouping)}
+	}
+	for i, tag := range c.Tags {
+		if tag == "" {
+			return &ConfigError{Key: fmt.Sprintf("tags[%d]", i), Err: fmt.Errorf("must not be empty")}
+		}
+	}
+
+	if !chainName.MatchString(c.Chains.Private) {
+		return &ConfigError{Key: "chains.private", Err: fmt.Errorf("invalid chain name %q", c.Chains.Private)}
+	}
+	if !chainName.MatchString(c.Chains.Public) {
+		return &ConfigError{Key: "chains.public", Err: fmt.Errorf("invalid chain name %q", c.Chains.Public)}
+	}
+	if c.Chains.Private == c.Chains.Public {
+		return &ConfigError{Key: "chains.public", Err: fmt.Errorf("must differ from chains.private")}
+	}
+
+	err := c.validateAllow()
+	if err != nil {
+		return err
+	}
+	return c.validatePolicies()
+}
+
+// needsIPTables returns the key of the first setting which only the iptables
+// backend supports, or "" when any backend can be used
+func (c *Config) needsIPTables() string {
+	if len(c.Policies) > 0 {
+		return "policies"
+	}
+	for _, addr := range c.Allow.Private {
+		if peer, _, err := discovery.ParseAllowed(addr); err == nil && strings.Contains(peer, "/") {
+			return "allow.private"
+		}
+	}
+	for _, addr := range c.Allow.Public {
+		if peer, _, err := discovery.ParseAllowed(addr); err == nil && strings.Contains(peer, "/") {
+			return "allow.public"
+		}
+	}
+	return ""
+}
+
+// validateAllow checks the static allowlists. Only the public interface is
+// filtered for ipv6, and only iptables can hold networks as peers.
+func (c *Config) validateAllow() error {
+	for i, addr := range c.Allow.Private {
+		key := fmt.Sprintf("allow.private[%d]", i)
+		_, v6, err := discovery.ParseAllowed(addr)
+		if err != nil {
+			return &ConfigError{Key: key, Err: err}
+		}
+		if v6 {
+			return &ConfigError{Key: key, Err: fmt.Errorf("ipv6 address %q on the private interface", addr)}
+		}
+	}
+	for i, addr := range c.Allow.Public {
+		if _, _, err := discovery.ParseAllowed(addr); err != nil {
+			return &ConfigError{Key: fmt.Sprintf("allow.public[%d]", i), Err: err}
+		}
+	}
+
+	if key := c.needsIPTables(); key == "allow.private" || key == "allow.public" {
+		if c.Backend != "auto" && c.Backend != "iptables" {
+			return &ConfigError{Key: key, Err: fmt.Errorf("networks are not supported by the %s backend", c.Backend)}
+		}
+	}
+	return nil
+}
+
+// validatePolicies checks that each policy can be compiled into its own chain
+func (c *Config) validatePolicies() error {
+	if c.needsIPTables() == "policies" && c.Backend != "auto" && c.Backend != "iptables" {
+		return &ConfigError{Key: "policies", Err: fmt.Errorf("not supported by the %s backend", c.Backend)}
+	}
+
+	tags := map[string]bool{}
+	for i, policy := range c.Policies {
+		key := fmt.Sprintf("policies[%d]", i)
+		if !policyTag.MatchString(policy.Tag) {
+			return &ConfigError{Key: key + ".tag", Err: fmt.Errorf("invalid tag %q", policy.Tag)}
+		}
+		if tags[policy.Tag] {
+			return &ConfigError{Key: key + ".tag", Err: fmt.Errorf("duplicate policy for tag %q", policy.Tag)}
+		}
+		tags[policy.Tag] = true
+		chain := firewall.PolicyChain(c.Chains.Private, policy.Tag)
+		if len(chain) > maxChainLen {
+			return &ConfigError{Key: key + ".tag", Err: fmt.Errorf("chain name %q is longer than %d characters", chain, maxChainLen)}
+		}
+		if chain == c.Chains.Public {
+			return &ConfigError{Key: key + ".tag", Err: fmt.Errorf("chain name %q is used by chains.public", chain)}
+		}
+
+		if len(policy.Ports) == 0 {
+			return &ConfigError{Key: key + ".ports", Err: fmt.Errorf("must not be empty")}
+		}
+		for j, port := range policy.Ports {
+			if _, _, err := firewall.ParsePort(port); err != nil {
+				return &ConfigError{Key: fmt.Sprintf("%s.ports[%d]", key, j), Err: err}
+			}
+		}
+	}
+	return nil
+}
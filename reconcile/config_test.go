@@ -0,0 +1,353 @@
+package reconcile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tam7t/droplan/firewall"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		exp    Config
+		expErr string
+	}{
+		{
+			name: "defaults are kept for missing keys",
+			data: `{"token": "abc", "tags": ["db"], "interval": "1m"}`,
+			exp: Config{
+				Token:            "abc",
+				Tags:             []string{"db"},
+				TagMode:          "any",
+				Grouping:         "vpc",
+				Interval:         Duration{time.Minute},
+				APIRetryBudget:   Duration{2 * time.Minute},
+				Timeout:          Duration{4 * time.Minute},
+				OperationTimeout: Duration{30 * time.Second},
+				MaxShrink:        50,
+				Backend:          "auto",
+				Chains:           ChainsConfig{Private: "droplan-peers", Public: "droplan-peers-public"},
+			},
+		},
+		{
+			name: "all keys",
+			data: `{
+				"token": "abc",
+				"tags": [],
+				"tag_mode": "all",
+				"grouping": "region",
+				"public": true,
+				"interval": 30,
+				"api_retry_budget": "10s",
+				"timeout": "1m",
+				"operation_timeout": "5s",
+				"max_shrink": 100,
+				"backend": "ipset",
+				"interfaces": {"private": "eth1", "public": "eth0"},
+				"chains": {"private": "peers", "public": "peers-public"}
+			}`,
+			exp: Config{
+				Token:            "abc",
+				Tags:             []string{},
+				TagMode:          "all",
+				Grouping:         "region",
+				Public:           true,
+				Interval:         Duration{30 * time.Second},
+				APIRetryBudget:   Duration{10 * time.Second},
+				Timeout:          Duration{time.Minute},
+				OperationTimeout: Duration{5 * time.Second},
+				MaxShrink:        100,
+				Backend:          "ipset",
+				Interfaces:       InterfacesConfig{Private: "eth1", Public: "eth0"},
+				Chains:           ChainsConfig{Private: "peers", Public: "peers-public"},
+			},
+		},
+		{
+			name:   "unknown key",
+			data:   `{"tokn": "abc"}`,
+			expErr: "tokn: unknown key",
+		},
+		{
+			name:   "wrong type",
+			data:   `{"public": "yes"}`,
+			expErr: "public: can not use string as bool",
+		},
+		{
+			name:   "nested wrong type",
+			data:   `{"chains": {"private": 1}}`,
+			expErr: "chains.private: can not use number as string",
+		},
+		{
+			name:   "bad duration",
+			data:   `{"interval": "5x"}`,
+			expErr: `interval: invalid duration "5x"`,
+		},
+		{
+			name:   "bad duration after a valid one",
+			data:   `{"timeout": "1m", "operation_timeout": true}`,
+			expErr: `operation_timeout: invalid duration true`,
+		},
+	}
+
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "droplan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(test.data)
+		f.Close()
+
+		out, err := LoadConfig(f.Name())
+		if test.expErr != "" {
+			exp := "config " + f.Name() + ": " + test.expErr
+			if err == nil || err.Error() != exp {
+				t.Logf("want:%v", exp)
+				t.Logf("got:%v", err)
+				t.Fatalf("test case failed: %s", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test case failed: %s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(out, test.exp) {
+			t.Logf("want:%+v", test.exp)
+			t.Logf("got:%+v", out)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		exp    Config
+		expErr error
+	}{
+		{
+			name: "no environment keeps the config",
+			env:  map[string]string{},
+			exp:  Config{Token: "file", Tags: []string{"file"}, Public: true, Interval: Duration{time.Minute}},
+		},
+		{
+			name: "environment overrides the config",
+			env:  map[string]string{"DO_KEY": "env", "DO_TAG": "env", "PUBLIC": "false", "DO_INTERVAL": "300"},
+			exp:  Config{Token: "env", Tags: []string{"env"}, Public: false, Interval: Duration{5 * time.Minute}},
+		},
+		{
+			name: "multiple tags",
+			env:  map[string]string{"DO_TAG": "prod, db", "DO_TAG_MODE": "all"},
+			exp:  Config{Token: "file", Tags: []string{"prod", "db"}, TagMode: "all", Public: true, Interval: Duration{time.Minute}},
+		},
+		{
+			name:   "bad interval",
+			env:    map[string]string{"DO_INTERVAL": "soon"},
+			exp:    Config{Token: "file", Tags: []string{"file"}, Public: true, Interval: Duration{time.Minute}},
+			expErr: &ConfigError{Key: "DO_INTERVAL", Err: errors.New(`invalid duration "soon"`)},
+		},
+		{
+			name: "timeouts",
+			env:  map[string]string{"DO_TIMEOUT": "2m", "DO_OPERATION_TIMEOUT": "10"},
+			exp:  Config{Token: "file", Tags: []string{"file"}, Public: true, Interval: Duration{time.Minute}, Timeout: Duration{2 * time.Minute}, OperationTimeout: Duration{10 * time.Second}},
+		},
+		{
+			name:   "bad operation timeout",
+			env:    map[string]string{"DO_OPERATION_TIMEOUT": "never"},
+			exp:    Config{Token: "file", Tags: []string{"file"}, Public: true, Interval: Duration{time.Minute}},
+			expErr: &ConfigError{Key: "DO_OPERATION_TIMEOUT", Err: errors.New(`invalid duration "never"`)},
+		},
+	}
+
+	for _, test := range tests {
+		cfg := Config{Token: "file", Tags: []string{"file"}, Public: true, Interval: Duration{time.Minute}}
+		err := cfg.ApplyEnv(func(key string) string { return test.env[key] })
+		if !reflect.DeepEqual(err, test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if !reflect.DeepEqual(cfg, test.exp) {
+			t.Logf("want:%+v", test.exp)
+			t.Logf("got:%+v", cfg)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		expErr string
+	}{
+		{
+			name:   "defaults are valid",
+			modify: func(*Config) {},
+		},
+		{
+			name:   "interval must be positive",
+			modify: func(c *Config) { c.Interval = Duration{0} },
+			expErr: "interval: must be positive, got 0s",
+		},
+		{
+			name:   "retry budget must not be negative",
+			modify: func(c *Config) { c.APIRetryBudget = Duration{-time.Second} },
+			expErr: "api_retry_budget: must not be negative, got -1s",
+		},
+		{
+			name:   "timeout must be positive",
+			modify: func(c *Config) { c.Timeout = Duration{0} },
+			expErr: "timeout: must be positive, got 0s",
+		},
+		{
+			name:   "operation timeout must be positive",
+			modify: func(c *Config) { c.OperationTimeout = Duration{-time.Second} },
+			expErr: "operation_timeout: must be positive, got -1s",
+		},
+		{
+			name:   "operation timeout must fit in the timeout",
+			modify: func(c *Config) { c.OperationTimeout = Duration{5 * time.Minute} },
+			expErr: "operation_timeout: must not be longer than timeout (4m0s), got 5m0s",
+		},
+		{
+			name:   "max shrink must be a percentage",
+			modify: func(c *Config) { c.MaxShrink = 150 },
+			expErr: "max_shrink: must be a percentage between 0 and 100, got 150",
+		},
+		{
+			name:   "unknown backend",
+			modify: func(c *Config) { c.Backend = "pf" },
+			expErr: `backend: unknown firewall backend "pf"`,
+		},
+		{
+			name:   "unknown tag mode",
+			modify: func(c *Config) { c.TagMode = "some" },
+			expErr: `tag_mode: must be "any" or "all", got "some"`,
+		},
+		{
+			name:   "unknown grouping",
+			modify: func(c *Config) { c.Grouping = "zone" },
+			expErr: `grouping: must be "vpc" or "region", got "zone"`,
+		},
+		{
+			name:   "empty tag",
+			modify: func(c *Config) { c.Tags = []string{""} },
+			expErr: "tags[0]: must not be empty",
+		},
+		{
+			name:   "chain name too long",
+			modify: func(c *Config) { c.Chains.Private = "droplan-peers-with-a-long-name" },
+			expErr: `chains.private: invalid chain name "droplan-peers-with-a-long-name"`,
+		},
+		{
+			name:   "chain names must differ",
+			modify: func(c *Config) { c.Chains.Public = c.Chains.Private },
+			expErr: "chains.public: must differ from chains.private",
+		},
+		{
+			name: "valid allowlists",
+			modify: func(c *Config) {
+				c.Allow = AllowConfig{Private: []string{"10.8.0.0/24"}, Public: []string{"203.0.113.7", "2001:db8::/32"}}
+			},
+		},
+		{
+			name:   "invalid allowed address",
+			modify: func(c *Config) { c.Allow.Public = []string{"203.0.113.7", "203.0.113"} },
+			expErr: `allow.public[1]: invalid address "203.0.113"`,
+		},
+		{
+			name:   "invalid allowed network",
+			modify: func(c *Config) { c.Allow.Private = []string{"10.8.0.0/33"} },
+			expErr: `allow.private[0]: invalid CIDR "10.8.0.0/33"`,
+		},
+		{
+			name:   "ipv6 is not allowed on the private interface",
+			modify: func(c *Config) { c.Allow.Private = []string{"2001:db8::1"} },
+			expErr: `allow.private[0]: ipv6 address "2001:db8::1" on the private interface`,
+		},
+		{
+			name: "allowed networks need the iptables backend",
+			modify: func(c *Config) {
+				c.Backend = "nftables"
+				c.Allow.Public = []string{"203.0.113.7", "198.51.100.0/24"}
+			},
+			expErr: "allow.public: networks are not supported by the nftables backend",
+		},
+		{
+			name: "allowed addresses work with any backend",
+			modify: func(c *Config) {
+				c.Backend = "nftables"
+				c.Allow.Public = []string{"203.0.113.7/32"}
+			},
+		},
+		{
+			name: "valid policies",
+			modify: func(c *Config) {
+				c.Policies = []firewall.Policy{{Tag: "web", Ports: []string{"tcp/5432"}}, {Tag: "env:prod", Ports: []string{"udp/8000:8100"}}}
+			},
+		},
+		{
+			name: "policies need the iptables backend",
+			modify: func(c *Config) {
+				c.Backend = "ipset"
+				c.Policies = []firewall.Policy{{Tag: "web", Ports: []string{"tcp/5432"}}}
+			},
+			expErr: "policies: not supported by the ipset backend",
+		},
+		{
+			name:   "policy tag must be set",
+			modify: func(c *Config) { c.Policies = []firewall.Policy{{Ports: []string{"tcp/5432"}}} },
+			expErr: `policies[0].tag: invalid tag ""`,
+		},
+		{
+			name: "duplicate policy tag",
+			modify: func(c *Config) {
+				c.Policies = []firewall.Policy{{Tag: "web", Ports: []string{"tcp/80"}}, {Tag: "web", Ports: []string{"tcp/443"}}}
+			},
+			expErr: `policies[1].tag: duplicate policy for tag "web"`,
+		},
+		{
+			name: "policy chain name too long",
+			modify: func(c *Config) {
+				c.Policies = []firewall.Policy{{Tag: "monitoring-agents", Ports: []string{"tcp/9100"}}}
+			},
+			expErr: `policies[0].tag: chain name "droplan-peers-monitoring-agents" is longer than 28 characters`,
+		},
+		{
+			name: "policy chain name used by the public chain",
+			modify: func(c *Config) {
+				c.Policies = []firewall.Policy{{Tag: "public", Ports: []string{"tcp/80"}}}
+			},
+			expErr: `policies[0].tag: chain name "droplan-peers-public" is used by chains.public`,
+		},
+		{
+			name:   "policy ports must be set",
+			modify: func(c *Config) { c.Policies = []firewall.Policy{{Tag: "web"}} },
+			expErr: "policies[0].ports: must not be empty",
+		},
+		{
+			name:   "invalid policy port",
+			modify: func(c *Config) { c.Policies = []firewall.Policy{{Tag: "web", Ports: []string{"tcp/80", "sctp/80"}}} },
+			expErr: `policies[0].ports[1]: invalid protocol "sctp" in port "sctp/80", expected tcp or udp`,
+		},
+	}
+
+	for _, test := range tests {
+		cfg := DefaultConfig()
+		test.modify(&cfg)
+		err := cfg.Validate()
+		if (err == nil && test.expErr != "") || (err != nil && err.Error() != test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
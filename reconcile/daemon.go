@@ -0,0 +1,88 @@
+package reconcile
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+const (
+	// minBackoff is the delay before retrying the first failed reconcile
+	minBackoff = 5 * time.Second
+)
+
+// Daemon repeatedly runs a reconcile function, waiting the configured interval
+// (plus jitter) between successful runs and backing off exponentially after
+// failed runs.
+type Daemon struct {
+	reconcile func() error
+	interval  time.Duration
+	jitter    float64
+	logger    *slog.Logger
+
+	// injected so that tests do not need to sleep
+	after  func(time.Duration) <-chan time.Time
+	random func() float64
+}
+
+// newDaemon returns a Daemon that calls reconcile every interval, delaying each
+// run by up to jitter*interval.
+func newDaemon(reconcile func() error, interval time.Duration, jitter float64) *Daemon {
+	return &Daemon{
+		reconcile: reconcile,
+		interval:  interval,
+		jitter:    jitter,
+		logger:    slog.Default(),
+		after:     time.After,
+		random:    rand.Float64,
+	}
+}
+
+// Run reconciles until the stop channel is closed. Errors are logged and
+// retried rather than returned, except for the error of a run which was
+// stopped.
+func (d *Daemon) Run(stop <-chan struct{}) {
+	failures := 0
+	for {
+		var wait time.Duration
+		err := d.reconcile()
+		select {
+		case <-stop:
+			// a run interrupted by stopping has not failed
+			return
+		default:
+		}
+		if err != nil {
+			failures++
+			wait = d.backoff(failures)
+			d.logger.Error("Reconcile failed", "attempt", failures, "retry_in", wait.String(), "err", err)
+		} else {
+			failures = 0
+			wait = d.next()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-d.after(wait):
+		}
+	}
+}
+
+// next returns the delay until the next scheduled reconcile
+func (d *Daemon) next() time.Duration {
+	return d.interval + time.Duration(d.jitter*d.random()*float64(d.interval))
+}
+
+// backoff returns the delay before retrying after the given number of
+// consecutive failures, capped at the regular interval
+func (d *Daemon) backoff(failures int) time.Duration {
+	wait := minBackoff
+	for i := 1; i < failures && wait < d.interval; i++ {
+		wait *= 2
+	}
+	if wait > d.interval {
+		wait = d.interval
+	}
+	return wait
+}
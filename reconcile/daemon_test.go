@@ -0,0 +1,98 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDaemonRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []error
+		exp     []time.Duration
+	}{
+		{
+			name:    "waits the interval plus jitter after success",
+			results: []error{nil, nil},
+			exp:     []time.Duration{110 * time.Second, 110 * time.Second},
+		},
+		{
+			name:    "backs off exponentially after failures",
+			results: []error{errors.New("a"), errors.New("b"), errors.New("c"), nil},
+			exp:     []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 110 * time.Second},
+		},
+		{
+			name:    "backoff is capped at the interval",
+			results: []error{errors.New("a"), errors.New("b"), errors.New("c"), errors.New("d"), errors.New("e"), errors.New("f")},
+			exp:     []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 100 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		waits := []time.Duration{}
+		stop := make(chan struct{})
+
+		d := newDaemon(func() error {
+			err := test.results[calls]
+			calls++
+			return err
+		}, 100*time.Second, 0.1)
+		d.random = func() float64 { return 1 }
+		d.after = func(wait time.Duration) <-chan time.Time {
+			waits = append(waits, wait)
+			if len(waits) == len(test.results) {
+				close(stop)
+				return nil
+			}
+			c := make(chan time.Time, 1)
+			c <- time.Time{}
+			return c
+		}
+
+		d.Run(stop)
+		if !reflect.DeepEqual(waits, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", waits)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestDaemonRunStops(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+
+	calls := 0
+	d := newDaemon(func() error {
+		calls++
+		return nil
+	}, time.Hour, 0)
+
+	d.Run(stop)
+	if calls != 1 {
+		t.Fatalf("want 1 reconcile, got %d", calls)
+	}
+}
+
+func TestDaemonRunStoppedDuringRun(t *testing.T) {
+	stop := make(chan struct{})
+
+	out := &bytes.Buffer{}
+	d := newDaemon(func() error {
+		// stopping cancels the run in progress
+		close(stop)
+		return context.Canceled
+	}, time.Hour, 0)
+	d.logger = slog.New(slog.NewTextHandler(out, nil))
+
+	d.Run(stop)
+	if out.Len() != 0 {
+		t.Fatalf("unexpected log: %s", out.String())
+	}
+}
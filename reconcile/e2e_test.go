@@ -0,0 +1,311 @@
+package reconcile
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/tam7t/droplan/discovery"
+	"github.com/tam7t/droplan/firewall"
+)
+
+// e2eMetadata is the metadata of droplet 1, the local droplet in the
+// end-to-end tests
+const e2eMetadata = `{
+	"droplet_id": 1,
+	"region": "nyc3",
+	"interfaces": {
+		"private": [{"mac": "04:01:2a:0f:2a:02", "type": "private", "ipv4": {"ip_address": "10.0.0.1"}}],
+		"public": [{"mac": "04:01:2a:0f:2a:01", "type": "public", "ipv4": {"ip_address": "1.1.1.1"}, "anchor_ipv4": {"ip_address": "10.20.0.5"}}]
+	},
+	"floating_ip": {"ipv4": {"ip_address": "2.2.2.1", "active": true}}
+}`
+
+// e2eDroplet returns a droplet in nyc3 with the private and public addresses
+func e2eDroplet(id int, vpc, private, public string, tags ...string) fakeDroplet {
+	networks := &godo.Networks{V4: []godo.NetworkV4{{IPAddress: private, Type: "private"}}}
+	if public != "" {
+		networks.V4 = append(networks.V4, godo.NetworkV4{IPAddress: public, Type: "public"})
+	}
+	return fakeDroplet{
+		Droplet: godo.Droplet{ID: id, Region: &godo.Region{Slug: "nyc3"}, Networks: networks, Tags: tags},
+		VPCUUID: vpc,
+	}
+}
+
+var e2eDroplets = []fakeDroplet{
+	e2eDroplet(1, "vpc-1", "10.0.0.1", "1.1.1.1", "db"),
+	e2eDroplet(2, "vpc-1", "10.0.0.2", "1.1.1.2", "db"),
+	e2eDroplet(3, "vpc-2", "10.1.0.3", "1.1.1.3", "db"),
+	e2eDroplet(4, "vpc-1", "10.0.0.4", "", "web"),
+}
+
+var e2eFloatingIPs = []godo.FloatingIP{
+	{IP: "2.2.2.1", Droplet: &godo.Droplet{ID: 1}},
+	{IP: "2.2.2.2", Droplet: &godo.Droplet{ID: 2}},
+	{IP: "2.2.2.5", Droplet: &godo.Droplet{ID: 5}},
+	{IP: "2.2.2.6"},
+}
+
+// newE2EReconciler returns a Reconciler updating the fake iptables with the fake
+// API and metadata service
+func newE2EReconciler(t *testing.T, api *fakeAPI, meta string, cfg Config) (*Reconciler, *fakeIPTables, func()) {
+	metaSrv := newFakeMetadata(meta)
+	ipt := newFakeIPTables()
+
+	cfg.Interfaces = InterfacesConfig{Private: "eth1", Public: "eth0"}
+	d, err := New(cfg,
+		WithClient(api.client()),
+		WithMetadata(metadataClient(metaSrv)),
+		WithFirewall(firewall.NewIPTablesFirewall(ipt, false), nil),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return d, ipt, metaSrv.Close
+}
+
+func TestReconcileEndToEnd(t *testing.T) {
+	local := []string{"10.0.0.1", "1.1.1.1", "10.20.0.5", "2.2.2.1"}
+
+	tests := []struct {
+		name       string
+		modify     func(*Config)
+		expPrivate []string
+		expPublic  []string
+		expRequest string
+	}{
+		{
+			name:       "peers in the same vpc",
+			expPrivate: []string{"10.0.0.2", "10.0.0.4"},
+		},
+		{
+			name:       "peers in the same region",
+			modify:     func(c *Config) { c.Grouping = discovery.GroupingRegion },
+			expPrivate: []string{"10.0.0.2", "10.1.0.3", "10.0.0.4"},
+		},
+		{
+			name:       "peers with a tag",
+			modify:     func(c *Config) { c.Tags = []string{"db"} },
+			expPrivate: []string{"10.0.0.2"},
+			expRequest: "/v2/droplets?page=2&tag_name=db",
+		},
+		{
+			name:       "vpc of a droplet without the tag",
+			modify:     func(c *Config) { c.Tags = []string{"web"} },
+			expPrivate: []string{"10.0.0.4"},
+			expRequest: "/v2/droplets/1",
+		},
+		{
+			name:       "public peers",
+			modify:     func(c *Config) { c.Public = true },
+			expPrivate: []string{"10.0.0.2", "10.0.0.4"},
+			expPublic:  []string{"1.1.1.2", "1.1.1.3", "2.2.2.2"},
+		},
+	}
+
+	for _, test := range tests {
+		api := newFakeAPI(e2eDroplets...)
+		api.floatingIPs = e2eFloatingIPs
+		// list a page at a time to exercise pagination
+		api.perPage = 1
+
+		cfg := DefaultConfig()
+		if test.modify != nil {
+			test.modify(&cfg)
+		}
+		d, ipt, closeMeta := newE2EReconciler(t, api, e2eMetadata, cfg)
+
+		err := d.Reconcile(context.Background())
+		if err != nil {
+			t.Fatalf("test case failed: %s: %v", test.name, err)
+		}
+
+		expPrivate := sortedPeers(discovery.MergePeers(test.expPrivate, local))
+		private := listedPeers(t, ipt, "droplan-peers")
+		if !reflect.DeepEqual(private, expPrivate) {
+			t.Logf("want:%v", expPrivate)
+			t.Logf("got:%v", private)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+
+		if test.expPublic != nil {
+			expPublic := sortedPeers(discovery.MergePeers(test.expPublic, local))
+			public := listedPeers(t, ipt, "droplan-peers-public")
+			if !reflect.DeepEqual(public, expPublic) {
+				t.Logf("want:%v", expPublic)
+				t.Logf("got:%v", public)
+				t.Fatalf("test case failed: %s", test.name)
+			}
+		} else if _, ok := ipt.chains["droplan-peers-public"]; ok {
+			t.Fatalf("test case failed: %s: public chain created", test.name)
+		}
+
+		if test.expRequest != "" && !hasRequest(api.requests, test.expRequest) {
+			t.Logf("want:%v", test.expRequest)
+			t.Logf("got:%v", api.requests)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+
+		closeMeta()
+		api.Close()
+	}
+}
+
+// hasRequest reports whether the request was made
+func hasRequest(requests []string, request string) bool {
+	for _, r := range requests {
+		if r == request {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedPeers returns the peers in sorted order, as the order rules are added
+// in is not significant
+func sortedPeers(peers []string) []string {
+	peers = append([]string{}, peers...)
+	sort.Strings(peers)
+	return peers
+}
+
+// listedPeers returns the sorted peers of the chain
+func listedPeers(t *testing.T, ipt firewall.IPTables, chain string) []string {
+	peers, err := firewall.ListPeers(ipt, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sortedPeers(peers)
+}
+
+func TestReconcileEndToEndUpdates(t *testing.T) {
+	api := newFakeAPI(e2eDroplets...)
+	defer api.Close()
+	d, ipt, closeMeta := newE2EReconciler(t, api, e2eMetadata, DefaultConfig())
+	defer closeMeta()
+
+	err := d.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing changes when reconciling the same droplets again
+	ipt.commands = nil
+	err = d.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ipt.commands) != 0 {
+		t.Logf("want:%v", []string{})
+		t.Logf("got:%v", ipt.commands)
+		t.Fatal("unexpected commands when nothing changed")
+	}
+
+	// a destroyed droplet is removed from the chain
+	api.setDroplets(e2eDroplets[:3]...)
+	err = d.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"-D droplan-peers -s 10.0.0.4/32 -j ACCEPT"}
+	if !reflect.DeepEqual(ipt.commands, exp) {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", ipt.commands)
+		t.Fatal("unexpected commands when a droplet was destroyed")
+	}
+}
+
+func TestUninstallEndToEnd(t *testing.T) {
+	api := newFakeAPI(e2eDroplets...)
+	defer api.Close()
+	cfg := DefaultConfig()
+	cfg.Public = true
+	d, ipt, closeMeta := newE2EReconciler(t, api, e2eMetadata, cfg)
+	defer closeMeta()
+
+	err := d.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// uninstalling twice removes everything and then finds nothing to remove
+	for i := 0; i < 2; i++ {
+		err = d.Uninstall(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := map[string][]string{"INPUT": {}}
+		if !reflect.DeepEqual(ipt.chains, exp) {
+			t.Logf("want:%v", exp)
+			t.Logf("got:%v", ipt.chains)
+			t.Fatal("unexpected chains after uninstall")
+		}
+	}
+}
+
+func TestReconcileEndToEndErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		expErr   string
+	}{
+		{
+			name:     "unauthorized token",
+			statuses: []int{401},
+			expErr:   "401 fake failure",
+		},
+		{
+			name:     "server error is retried",
+			statuses: []int{503},
+		},
+	}
+
+	for _, test := range tests {
+		api := newFakeAPI(e2eDroplets...)
+		api.statuses = test.statuses
+		d, ipt, closeMeta := newE2EReconciler(t, api, e2eMetadata, DefaultConfig())
+
+		err := d.Reconcile(context.Background())
+		if (err == nil && test.expErr != "") || (err != nil && !strings.HasSuffix(err.Error(), test.expErr)) || (err != nil && test.expErr == "") {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+		if err != nil && len(ipt.commands) != 0 {
+			t.Logf("got:%v", ipt.commands)
+			t.Fatalf("test case failed: %s: firewall changed after an API error", test.name)
+		}
+
+		closeMeta()
+		api.Close()
+	}
+}
+
+func TestReconcileEndToEndTimeout(t *testing.T) {
+	api := newFakeAPI(e2eDroplets...)
+	api.hang = make(chan struct{})
+	defer api.Close()
+
+	cfg := DefaultConfig()
+	cfg.Timeout = Duration{10 * time.Millisecond}
+	d, ipt, closeMeta := newE2EReconciler(t, api, e2eMetadata, cfg)
+	defer closeMeta()
+	defer close(api.hang)
+
+	err := d.Reconcile(context.Background())
+	exp := "reconcile did not finish within 10ms: context deadline exceeded"
+	if err == nil || err.Error() != exp {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", err)
+		t.Fatal("unexpected error from a hung API")
+	}
+	if len(ipt.commands) != 0 {
+		t.Logf("got:%v", ipt.commands)
+		t.Fatal("firewall changed after the run timed out")
+	}
+}
@@ -0,0 +1,329 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/go-metadata"
+	"github.com/digitalocean/godo"
+	"github.com/tam7t/droplan/discovery"
+)
+
+// fakeDroplet is a droplet served by the fake API, along with the VPC it is in
+type fakeDroplet struct {
+	godo.Droplet
+	VPCUUID string `json:"vpc_uuid,omitempty"`
+}
+
+// fakeAPI is a stand-in for the DigitalOcean API serving droplets and floating
+// IPs from memory. Lists are paginated perPage items at a time.
+type fakeAPI struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	droplets    []fakeDroplet
+	floatingIPs []godo.FloatingIP
+	perPage     int
+	// statuses are returned, in order, instead of handling the next requests
+	statuses []int
+	// requests records the path and query of each request
+	requests []string
+	// hang, when set, holds every request until it is closed
+	hang chan struct{}
+}
+
+func newFakeAPI(droplets ...fakeDroplet) *fakeAPI {
+	f := &fakeAPI{droplets: droplets, perPage: 20}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/droplets", f.listDroplets)
+	mux.HandleFunc("/v2/droplets/", f.getDroplet)
+	mux.HandleFunc("/v2/floating_ips", f.listFloatingIPs)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.hang != nil {
+			<-f.hang
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.requests = append(f.requests, r.URL.RequestURI())
+		if len(f.statuses) > 0 {
+			status := f.statuses[0]
+			f.statuses = f.statuses[1:]
+			// retried failures wait the shortest backoff
+			w.Header().Set("Retry-After", "0")
+			writeAPIError(w, status, "fake failure")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return f
+}
+
+// client returns a godo client which sends its requests to the fake
+func (f *fakeAPI) client() *godo.Client {
+	client := godo.NewClient(nil)
+	client.BaseURL, _ = url.Parse(f.URL + "/")
+	return client
+}
+
+// setDroplets replaces the droplets served by the fake
+func (f *fakeAPI) setDroplets(droplets ...fakeDroplet) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.droplets = droplets
+}
+
+func (f *fakeAPI) listDroplets(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag_name")
+
+	droplets := []fakeDroplet{}
+	for _, d := range f.droplets {
+		if tag == "" || (discovery.Peer{Tags: d.Tags}).HasTag(tag) {
+			droplets = append(droplets, d)
+		}
+	}
+
+	start, end, links := f.paginate(r, len(droplets))
+	writeJSON(w, map[string]interface{}{
+		"droplets": droplets[start:end],
+		"links":    links,
+		"meta":     map[string]int{"total": len(droplets)},
+	})
+}
+
+func (f *fakeAPI) getDroplet(w http.ResponseWriter, r *http.Request) {
+	for _, d := range f.droplets {
+		if strconv.Itoa(d.ID) == strings.TrimPrefix(r.URL.Path, "/v2/droplets/") {
+			writeJSON(w, map[string]interface{}{"droplet": d})
+			return
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, "The resource you were accessing could not be found.")
+}
+
+func (f *fakeAPI) listFloatingIPs(w http.ResponseWriter, r *http.Request) {
+	start, end, links := f.paginate(r, len(f.floatingIPs))
+	writeJSON(w, map[string]interface{}{
+		"floating_ips": f.floatingIPs[start:end],
+		"links":        links,
+		"meta":         map[string]int{"total": len(f.floatingIPs)},
+	})
+}
+
+// paginate returns the range of the n items listed on the requested page and
+// the links to the pages around it
+func (f *fakeAPI) paginate(r *http.Request, n int) (int, int, godo.Links) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	last := (n + f.perPage - 1) / f.perPage
+	if last < 1 {
+		last = 1
+	}
+
+	pageURL := func(p int) string {
+		u := *r.URL
+		q := u.Query()
+		q.Set("page", strconv.Itoa(p))
+		u.RawQuery = q.Encode()
+		return f.URL + u.RequestURI()
+	}
+
+	links := godo.Links{Pages: &godo.Pages{}}
+	if page > 1 {
+		links.Pages.First, links.Pages.Prev = pageURL(1), pageURL(page-1)
+	}
+	if page < last {
+		links.Pages.Next, links.Pages.Last = pageURL(page+1), pageURL(last)
+	}
+
+	start := (page - 1) * f.perPage
+	end := start + f.perPage
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return start, end, links
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"id": strings.ToLower(http.StatusText(status)), "message": message})
+}
+
+// newFakeMetadata returns a stand-in for the droplet metadata service serving
+// the JSON metadata document
+func newFakeMetadata(data string) *httptest.Server {
+	var md metadata.Metadata
+	if err := json.Unmarshal([]byte(data), &md); err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata/v1.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, data)
+	})
+	mux.HandleFunc("/metadata/v1/region", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, md.Region)
+	})
+	mux.HandleFunc("/metadata/v1/id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, md.DropletID)
+	})
+	return httptest.NewServer(mux)
+}
+
+// metadataClient returns a metadata client which sends its requests to the
+// fake metadata service
+func metadataClient(srv *httptest.Server) *metadata.Client {
+	u, _ := url.Parse(srv.URL)
+	return metadata.NewClient(metadata.WithBaseURL(u))
+}
+
+// fakeIPTables keeps the filter table in memory the way iptables would, and
+// records each command which changed it
+type fakeIPTables struct {
+	chains   map[string][]string
+	commands []string
+}
+
+func newFakeIPTables() *fakeIPTables {
+	return &fakeIPTables{chains: map[string][]string{"INPUT": {}}}
+}
+
+var (
+	errFakeChainExists = errors.New("exit status 1: iptables: Chain already exists.\n")
+	errFakeNoChain     = errors.New("exit status 1: iptables: No chain/target/match by that name.\n")
+	errFakeNoRule      = errors.New("exit status 1: iptables: Bad rule (does a matching rule exist in that chain?).\n")
+	errFakeNotEmpty    = errors.New("exit status 1: iptables: Directory not empty.\n")
+)
+
+// fakeRule returns the rulespec as iptables lists it, with the prefix length
+// of single host sources
+func fakeRule(rulespec []string) string {
+	fields := append([]string{}, rulespec...)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-s" && !strings.Contains(fields[i+1], "/") {
+			if ip := net.ParseIP(fields[i+1]); ip != nil && ip.To4() != nil {
+				fields[i+1] += "/32"
+			} else if ip != nil {
+				fields[i+1] += "/128"
+			}
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func (f *fakeIPTables) record(flag, chain string, rule ...string) {
+	f.commands = append(f.commands, strings.Join(append([]string{flag, chain}, rule...), " "))
+}
+
+func (f *fakeIPTables) index(chain, rule string) int {
+	for i, r := range f.chains[chain] {
+		if r == rule {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeIPTables) NewChain(table, chain string) error {
+	if _, ok := f.chains[chain]; ok {
+		return errFakeChainExists
+	}
+	f.chains[chain] = []string{}
+	f.record("-N", chain)
+	return nil
+}
+
+func (f *fakeIPTables) ClearChain(table, chain string) error {
+	// like go-iptables, clearing a missing chain creates it
+	f.chains[chain] = []string{}
+	f.record("-F", chain)
+	return nil
+}
+
+func (f *fakeIPTables) Append(table, chain string, rulespec ...string) error {
+	if _, ok := f.chains[chain]; !ok {
+		return errFakeNoChain
+	}
+	rule := fakeRule(rulespec)
+	f.chains[chain] = append(f.chains[chain], rule)
+	f.record("-A", chain, rule)
+	return nil
+}
+
+func (f *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	if exists, err := f.Exists(table, chain, rulespec...); err != nil || exists {
+		return err
+	}
+	return f.Append(table, chain, rulespec...)
+}
+
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	if _, ok := f.chains[chain]; !ok {
+		return errFakeNoChain
+	}
+	rule := fakeRule(rulespec)
+	i := f.index(chain, rule)
+	if i < 0 {
+		return errFakeNoRule
+	}
+	f.chains[chain] = append(f.chains[chain][:i], f.chains[chain][i+1:]...)
+	f.record("-D", chain, rule)
+	return nil
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	if _, ok := f.chains[chain]; !ok {
+		return false, errFakeNoChain
+	}
+	return f.index(chain, fakeRule(rulespec)) >= 0, nil
+}
+
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	rules, ok := f.chains[chain]
+	if !ok {
+		return nil, errFakeNoChain
+	}
+	listed := []string{"-N " + chain}
+	if chain == "INPUT" {
+		listed = []string{"-P INPUT ACCEPT"}
+	}
+	for _, rule := range rules {
+		listed = append(listed, "-A "+chain+" "+rule)
+	}
+	return listed, nil
+}
+
+func (f *fakeIPTables) DeleteChain(table, chain string) error {
+	rules, ok := f.chains[chain]
+	if !ok {
+		return errFakeNoChain
+	}
+	if len(rules) > 0 {
+		return errFakeNotEmpty
+	}
+	delete(f.chains, chain)
+	f.record("-X", chain)
+	return nil
+}
@@ -0,0 +1,62 @@
+package reconcile
+
+import "fmt"
+
+// GuardError is returned instead of updating a chain (or set) with peers that
+// look like the result of a failed discovery, such as a token without access
+// to the droplets or a mistyped tag
+type GuardError struct {
+	Chain     string
+	Current   int
+	Desired   int
+	MaxShrink int
+}
+
+func (e *GuardError) Error() string {
+	if e.Desired == 0 && e.Current == 0 {
+		return fmt.Sprintf("refusing to set up %s without any peers, run with -force to apply", e.Chain)
+	}
+	if e.Desired == 0 {
+		return fmt.Sprintf("refusing to remove all %d peers from %s, run with -force to apply", e.Current, e.Chain)
+	}
+	return fmt.Sprintf("refusing to shrink %s from %d to %d peers, more than %d%%, run with -force to apply", e.Chain, e.Current, e.Desired, e.MaxShrink)
+}
+
+// CheckPeers returns a GuardError when the desired peers are empty, even if
+// the chain is too, or replacing the current peers of the chain with them
+// would shrink it by more than maxShrink percent
+func CheckPeers(chain string, current, desired []string, maxShrink int) error {
+	have, want := countUnique(current), countUnique(desired)
+	if want > 0 && want >= have {
+		return nil
+	}
+	if want == 0 || (have-want)*100 > maxShrink*have {
+		return &GuardError{Chain: chain, Current: have, Desired: want, MaxShrink: maxShrink}
+	}
+	return nil
+}
+
+// withoutPeers returns the peers which are not in remove
+func withoutPeers(peers, remove []string) []string {
+	removed := map[string]bool{}
+	for _, peer := range remove {
+		removed[peer] = true
+	}
+
+	kept := []string{}
+	for _, peer := range peers {
+		if !removed[peer] {
+			kept = append(kept, peer)
+		}
+	}
+	return kept
+}
+
+// countUnique returns the number of distinct values
+func countUnique(values []string) int {
+	seen := map[string]bool{}
+	for _, v := range values {
+		seen[v] = true
+	}
+	return len(seen)
+}
@@ -0,0 +1,190 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/tam7t/droplan/firewall"
+)
+
+func TestCheckPeers(t *testing.T) {
+	current := []string{"peer1", "peer2", "peer3", "peer4"}
+
+	tests := []struct {
+		name      string
+		current   []string
+		desired   []string
+		maxShrink int
+		exp       error
+	}{
+		{
+			name:      "growing",
+			current:   current,
+			desired:   append([]string{"peer5"}, current...),
+			maxShrink: 50,
+		},
+		{
+			name:      "shrinking within the limit",
+			current:   current,
+			desired:   []string{"peer1", "peer2"},
+			maxShrink: 50,
+		},
+		{
+			name:      "shrinking past the limit",
+			current:   current,
+			desired:   []string{"peer1"},
+			maxShrink: 50,
+			exp:       &GuardError{Chain: "droplan-peers", Current: 4, Desired: 1, MaxShrink: 50},
+		},
+		{
+			name:      "duplicates are counted once",
+			current:   current,
+			desired:   []string{"peer1", "peer1", "peer1"},
+			maxShrink: 50,
+			exp:       &GuardError{Chain: "droplan-peers", Current: 4, Desired: 1, MaxShrink: 50},
+		},
+		{
+			name:      "emptying",
+			current:   current,
+			desired:   []string{},
+			maxShrink: 100,
+			exp:       &GuardError{Chain: "droplan-peers", Current: 4, Desired: 0, MaxShrink: 100},
+		},
+		{
+			name:      "empty chain",
+			current:   []string{},
+			desired:   []string{},
+			maxShrink: 100,
+			exp:       &GuardError{Chain: "droplan-peers", Current: 0, Desired: 0, MaxShrink: 100},
+		},
+		{
+			name:      "filling an empty chain",
+			current:   []string{},
+			desired:   []string{"peer1"},
+			maxShrink: 0,
+		},
+	}
+
+	for _, test := range tests {
+		err := CheckPeers("droplan-peers", test.current, test.desired, test.maxShrink)
+		if !reflect.DeepEqual(err, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestGuardErrorMessage(t *testing.T) {
+	tests := []struct {
+		err *GuardError
+		exp string
+	}{
+		{
+			err: &GuardError{Chain: "droplan-peers", Current: 0, Desired: 0, MaxShrink: 50},
+			exp: "refusing to set up droplan-peers without any peers, run with -force to apply",
+		},
+		{
+			err: &GuardError{Chain: "droplan-peers", Current: 4, Desired: 0, MaxShrink: 50},
+			exp: "refusing to remove all 4 peers from droplan-peers, run with -force to apply",
+		},
+		{
+			err: &GuardError{Chain: "droplan-peers", Current: 4, Desired: 1, MaxShrink: 50},
+			exp: "refusing to shrink droplan-peers from 4 to 1 peers, more than 50%, run with -force to apply",
+		},
+	}
+
+	for _, test := range tests {
+		if test.err.Error() != test.exp {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", test.err.Error())
+			t.Fatal("unexpected error message")
+		}
+	}
+}
+
+func TestDroplanApplyGuard(t *testing.T) {
+	tests := []struct {
+		name      string
+		force     bool
+		expErr    bool
+		expUpdate bool
+	}{
+		{
+			name:   "refuses to empty the chain",
+			expErr: true,
+		},
+		{
+			name:      "applies when forced",
+			force:     true,
+			expUpdate: true,
+		},
+	}
+
+	for _, test := range tests {
+		updated := false
+		fw := &stubFirewall{
+			setup: func(string, string) error { return nil },
+			peers: func(string) ([]string, error) { return []string{"peer1", "peer2", "peer3"}, nil },
+			updatePeers: func(peers []string, chain string) (firewall.PeerChanges, error) {
+				// the local address is kept
+				if !reflect.DeepEqual(peers, []string{"peer3"}) {
+					t.Fatalf("unexpected peers: %v", peers)
+				}
+				updated = true
+				return firewall.PeerChanges{Added: []string{}, Removed: []string{"peer1", "peer2"}, Unchanged: 1}, nil
+			},
+		}
+		r := &Reconciler{fw: fw, cfg: DefaultConfig(), metrics: NewMetrics(), force: test.force}
+
+		err := r.apply(context.Background(), slog.Default(), fw, "eth1", []string{}, []string{"peer3"}, "droplan-peers")
+		if (err != nil) != test.expErr || updated != test.expUpdate {
+			t.Logf("want: error %v, updated %v", test.expErr, test.expUpdate)
+			t.Logf("got: error %v, updated %v", err, updated)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestDroplanApplyGuardNewChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		peers    []string
+		expErr   bool
+		expSetup bool
+	}{
+		{
+			name:   "refuses to set up without peers",
+			peers:  []string{},
+			expErr: true,
+		},
+		{
+			name:     "sets up with peers",
+			peers:    []string{"peer1"},
+			expSetup: true,
+		},
+	}
+
+	for _, test := range tests {
+		setup := false
+		fw := &stubFirewall{
+			setup: func(string, string) error { setup = true; return nil },
+			check: func(string) error { return errors.New("chain does not exist") },
+			peers: func(string) ([]string, error) { return nil, errors.New("chain does not exist") },
+			updatePeers: func(peers []string, chain string) (firewall.PeerChanges, error) {
+				return firewall.PeerChanges{Added: peers, Removed: []string{}}, nil
+			},
+		}
+		r := &Reconciler{fw: fw, cfg: DefaultConfig(), metrics: NewMetrics()}
+
+		err := r.apply(context.Background(), slog.Default(), fw, "eth1", test.peers, []string{"peer3"}, "droplan-peers")
+		if (err != nil) != test.expErr || setup != test.expSetup {
+			t.Logf("want: error %v, setup %v", test.expErr, test.expSetup)
+			t.Logf("got: error %v, setup %v", err, setup)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Ready returns an error unless the last reconcile succeeded at most maxAge
+// before now and every chain (or set) it updated still exists. Checking a
+// chain is abandoned once the context is done.
+func (r *Reconciler) Ready(ctx context.Context, now time.Time, maxAge time.Duration) error {
+	last := r.metrics.LastSync()
+	if last.IsZero() {
+		return errors.New("no successful reconcile yet")
+	}
+	if age := now.Sub(last); age > maxAge {
+		return fmt.Errorf("last successful reconcile was %s ago", age.Round(time.Second))
+	}
+
+	for _, c := range r.metrics.chains() {
+		fw := r.fw
+		if c.family == "ipv6" {
+			fw = r.fw6
+		}
+		if fw == nil {
+			continue
+		}
+
+		err := r.withTimeout(ctx, func(ctx context.Context) error {
+			return fw.Check(ctx, c.chain)
+		})
+		if err != nil {
+			return fmt.Errorf("chain %s (%s) is missing: %v", c.chain, c.family, err)
+		}
+	}
+	return nil
+}
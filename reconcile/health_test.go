@@ -0,0 +1,68 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	now := time.Unix(1000, 0)
+	exists := func(string) error { return nil }
+	missing := func(chain string) error {
+		if chain == "droplan-peers-public" {
+			return errors.New("exit status 1: ip6tables: No chain/target/match by that name.")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		lastSync time.Time
+		check6   func(string) error
+		exp      string
+	}{
+		{
+			name:     "recent sync and existing chains",
+			lastSync: now.Add(-time.Minute),
+			check6:   exists,
+		},
+		{
+			name:   "no sync yet",
+			check6: exists,
+			exp:    "no successful reconcile yet",
+		},
+		{
+			name:     "sync too long ago",
+			lastSync: now.Add(-20 * time.Minute),
+			check6:   exists,
+			exp:      "last successful reconcile was 20m0s ago",
+		},
+		{
+			name:     "missing chain",
+			lastSync: now.Add(-time.Minute),
+			check6:   missing,
+			exp:      "chain droplan-peers-public (ipv6) is missing: exit status 1: ip6tables: No chain/target/match by that name.",
+		},
+	}
+
+	for _, test := range tests {
+		r := &Reconciler{
+			cfg:     DefaultConfig(),
+			fw:      &stubFirewall{check: exists},
+			fw6:     &stubFirewall{check: test.check6},
+			metrics: NewMetrics(),
+		}
+		r.metrics.lastSync = test.lastSync
+		r.metrics.SetPeers("droplan-peers", "ipv4", 1)
+		r.metrics.SetPeers("droplan-peers-public", "ipv6", 1)
+
+		err := r.Ready(context.Background(), now, 15*time.Minute)
+		if (err == nil && test.exp != "") || (err != nil && err.Error() != test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
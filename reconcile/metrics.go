@@ -0,0 +1,232 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/tam7t/droplan/discovery"
+)
+
+// Metrics collects the values served on /metrics in daemon mode, written in
+// the Prometheus text exposition format
+type Metrics struct {
+	mu sync.Mutex
+
+	peers            map[peerLabels]int
+	lastSync         time.Time
+	syncDuration     time.Duration
+	apiRequests      int
+	apiErrors        int
+	rateRemaining    int
+	rateKnown        bool
+	firewallFailures int
+
+	now func() time.Time
+}
+
+// peerLabels identifies the chain (or set) a peer count is for
+type peerLabels struct {
+	chain  string
+	family string
+}
+
+// NewMetrics returns an empty set of metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		peers: map[peerLabels]int{},
+		now:   time.Now,
+	}
+}
+
+// Sync wraps reconcile to record how long each run takes and when the last
+// successful run finished
+func (m *Metrics) Sync(reconcile func() error) func() error {
+	return func() error {
+		start := m.now()
+		err := reconcile()
+		end := m.now()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.syncDuration = end.Sub(start)
+		if err == nil {
+			m.lastSync = end
+		}
+		return err
+	}
+}
+
+// SetPeers records the number of peers held by the chain (or set) for the
+// address family, "ipv4" or "ipv6"
+func (m *Metrics) SetPeers(chain, family string, peers int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peers[peerLabels{chain: chain, family: family}] = peers
+}
+
+// FirewallFailed records a firewall update which failed
+func (m *Metrics) FirewallFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.firewallFailures++
+}
+
+// APIRequest records a DigitalOcean API request along with the rate limit
+// remaining from its response, when there was one
+func (m *Metrics) APIRequest(resp *godo.Response, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiRequests++
+	if err != nil {
+		m.apiErrors++
+	}
+	if resp != nil && resp.Response != nil {
+		m.rateRemaining = resp.Rate.Remaining
+		m.rateKnown = true
+	}
+}
+
+// LastSync returns when the last successful reconcile finished, which is the
+// zero time before the first one
+func (m *Metrics) LastSync() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastSync
+}
+
+// chains returns the chain (or set) and address family of every peer count
+// recorded, in order
+func (m *Metrics) chains() []peerLabels {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedChains()
+}
+
+func (m *Metrics) sortedChains() []peerLabels {
+	labels := []peerLabels{}
+	for l := range m.peers {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].chain != labels[j].chain {
+			return labels[i].chain < labels[j].chain
+		}
+		return labels[i].family < labels[j].family
+	})
+	return labels
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := &expositionWriter{w: w}
+
+	e.header("droplan_peers", "gauge", "Number of peers (or policy rules) held by each chain (or set).")
+	for _, l := range m.sortedChains() {
+		e.printf("droplan_peers{chain=%q,family=%q} %d\n", l.chain, l.family, m.peers[l])
+	}
+
+	e.header("droplan_last_sync_timestamp_seconds", "gauge", "Unix time of the last successful reconcile.")
+	lastSync := 0.0
+	if !m.lastSync.IsZero() {
+		lastSync = float64(m.lastSync.UnixNano()) / 1e9
+	}
+	e.printf("droplan_last_sync_timestamp_seconds %g\n", lastSync)
+
+	e.header("droplan_sync_duration_seconds", "gauge", "Duration of the last reconcile.")
+	e.printf("droplan_sync_duration_seconds %g\n", m.syncDuration.Seconds())
+
+	e.header("droplan_api_requests_total", "counter", "Number of DigitalOcean API requests.")
+	e.printf("droplan_api_requests_total %d\n", m.apiRequests)
+
+	e.header("droplan_api_errors_total", "counter", "Number of DigitalOcean API requests which failed.")
+	e.printf("droplan_api_errors_total %d\n", m.apiErrors)
+
+	if m.rateKnown {
+		e.header("droplan_api_rate_limit_remaining", "gauge", "DigitalOcean API requests remaining in the current rate limit window.")
+		e.printf("droplan_api_rate_limit_remaining %d\n", m.rateRemaining)
+	}
+
+	e.header("droplan_firewall_failures_total", "counter", "Number of firewall updates which failed.")
+	e.printf("droplan_firewall_failures_total %d\n", m.firewallFailures)
+
+	return e.n, e.err
+}
+
+// ServeHTTP serves the metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// expositionWriter writes lines until the first error
+type expositionWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (e *expositionWriter) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(e.w, format, args...)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *expositionWriter) header(name, typ, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// meteredDroplets records the List and ListByTag requests droplan makes in
+// its metrics
+type meteredDroplets struct {
+	godo.DropletsService
+	metrics *Metrics
+}
+
+func (d *meteredDroplets) List(opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	droplets, resp, err := d.DropletsService.List(opt)
+	d.metrics.APIRequest(resp, err)
+	return droplets, resp, err
+}
+
+func (d *meteredDroplets) ListByTag(tag string, opt *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	droplets, resp, err := d.DropletsService.ListByTag(tag, opt)
+	d.metrics.APIRequest(resp, err)
+	return droplets, resp, err
+}
+
+// meteredVPCs records the VPC requests droplan makes in its metrics
+type meteredVPCs struct {
+	discovery.VPCService
+	metrics *Metrics
+}
+
+func (v *meteredVPCs) DropletVPC(ctx context.Context, dropletID int) (string, *godo.Response, error) {
+	vpc, resp, err := v.VPCService.DropletVPC(ctx, dropletID)
+	v.metrics.APIRequest(resp, err)
+	return vpc, resp, err
+}
+
+// meteredFloatingIPs records the floating IP requests droplan makes in its
+// metrics
+type meteredFloatingIPs struct {
+	godo.FloatingIPsService
+	metrics *Metrics
+}
+
+func (f *meteredFloatingIPs) List(opt *godo.ListOptions) ([]godo.FloatingIP, *godo.Response, error) {
+	ips, resp, err := f.FloatingIPsService.List(opt)
+	f.metrics.APIRequest(resp, err)
+	return ips, resp, err
+}
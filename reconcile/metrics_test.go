@@ -0,0 +1,114 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/tam7t/droplan/discovery"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics()
+	times := []time.Time{time.Unix(100, 0), time.Unix(102, 500000000), time.Unix(200, 0), time.Unix(201, 0)}
+	m.now = func() time.Time {
+		now := times[0]
+		times = times[1:]
+		return now
+	}
+
+	m.SetPeers("droplan-peers-public", "ipv6", 1)
+	m.SetPeers("droplan-peers-public", "ipv4", 2)
+	m.SetPeers("droplan-peers", "ipv4", 3)
+	m.FirewallFailed()
+
+	// the first run succeeds and the second fails
+	m.Sync(func() error { return nil })()
+	m.Sync(func() error { return errors.New("sync error") })()
+
+	m.APIRequest(&godo.Response{Response: &http.Response{}, Rate: godo.Rate{Remaining: 4999}}, nil)
+	m.APIRequest(nil, errors.New("api error"))
+
+	out := &bytes.Buffer{}
+	_, err := m.WriteTo(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := `# HELP droplan_peers Number of peers (or policy rules) held by each chain (or set).
+# TYPE droplan_peers gauge
+droplan_peers{chain="droplan-peers",family="ipv4"} 3
+droplan_peers{chain="droplan-peers-public",family="ipv4"} 2
+droplan_peers{chain="droplan-peers-public",family="ipv6"} 1
+# HELP droplan_last_sync_timestamp_seconds Unix time of the last successful reconcile.
+# TYPE droplan_last_sync_timestamp_seconds gauge
+droplan_last_sync_timestamp_seconds 102.5
+# HELP droplan_sync_duration_seconds Duration of the last reconcile.
+# TYPE droplan_sync_duration_seconds gauge
+droplan_sync_duration_seconds 1
+# HELP droplan_api_requests_total Number of DigitalOcean API requests.
+# TYPE droplan_api_requests_total counter
+droplan_api_requests_total 2
+# HELP droplan_api_errors_total Number of DigitalOcean API requests which failed.
+# TYPE droplan_api_errors_total counter
+droplan_api_errors_total 1
+# HELP droplan_api_rate_limit_remaining DigitalOcean API requests remaining in the current rate limit window.
+# TYPE droplan_api_rate_limit_remaining gauge
+droplan_api_rate_limit_remaining 4999
+# HELP droplan_firewall_failures_total Number of firewall updates which failed.
+# TYPE droplan_firewall_failures_total counter
+droplan_firewall_failures_total 1
+`
+	if out.String() != exp {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out.String())
+		t.Fatal("unexpected metrics")
+	}
+}
+
+func TestMeteredDroplets(t *testing.T) {
+	m := NewMetrics()
+	ds := &meteredDroplets{
+		DropletsService: &stubDroplets{
+			list: func(*godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+				return []godo.Droplet{}, &godo.Response{Response: &http.Response{}, Rate: godo.Rate{Remaining: 10}}, nil
+			},
+			listTag: func(string, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+				return nil, &godo.Response{Response: &http.Response{}, Rate: godo.Rate{Remaining: 9}}, errors.New("api error")
+			},
+		},
+		metrics: m,
+	}
+
+	_, err := discovery.DropletList(context.Background(), ds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = discovery.DropletListTags(context.Background(), ds, "db")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if m.apiRequests != 2 || m.apiErrors != 1 || m.rateRemaining != 9 {
+		t.Fatalf("unexpected api metrics: requests %d, errors %d, remaining %d", m.apiRequests, m.apiErrors, m.rateRemaining)
+	}
+}
+
+// stubDroplets lists droplets with the given functions, other requests panic
+type stubDroplets struct {
+	godo.DropletsService
+	list    func(*godo.ListOptions) ([]godo.Droplet, *godo.Response, error)
+	listTag func(string, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error)
+}
+
+func (s *stubDroplets) List(a *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	return s.list(a)
+}
+
+func (s *stubDroplets) ListByTag(a string, b *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+	return s.listTag(a, b)
+}
@@ -0,0 +1,565 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/digitalocean/go-metadata"
+	"github.com/digitalocean/godo"
+	"github.com/tam7t/droplan/discovery"
+	"github.com/tam7t/droplan/firewall"
+	"golang.org/x/oauth2"
+)
+
+// Reconciler holds the long lived clients needed to reconcile the local
+// firewall with the droplets listed in the DigitalOcean API
+type Reconciler struct {
+	droplets    godo.DropletsService
+	vpcs        discovery.VPCService
+	floatingIPs godo.FloatingIPsService
+	meta        *metadata.Client
+	fw          firewall.Firewall
+	fw6         firewall.Firewall
+	cfg         Config
+	metrics     *Metrics
+	logger      *slog.Logger
+	force       bool
+	jitter      float64
+	dryRun      io.Writer
+	// allBackends tears down the rules of every installed backend in
+	// Uninstall, since the auto backend can not tell which one added them
+	allBackends bool
+	// replaced is the backend the auto backend would have used if iptables
+	// was not needed, which must not hold any chains (or sets)
+	replaced firewall.Firewall
+
+	// only used while building the Reconciler
+	client *godo.Client
+}
+
+// Option configures a Reconciler built by New
+type Option func(*Reconciler)
+
+// WithClient lists droplets, VPCs and floating IPs with the given client
+// instead of one authenticated with the configured token. Its requests are
+// limited by its own timeout rather than the operation timeout.
+func WithClient(client *godo.Client) Option {
+	return func(r *Reconciler) { r.client = client }
+}
+
+// WithMetadata reads the droplet's metadata with the given client instead of
+// the local metadata service. Its requests are limited by its own timeout
+// rather than the operation timeout.
+func WithMetadata(meta *metadata.Client) Option {
+	return func(r *Reconciler) { r.meta = meta }
+}
+
+// WithFirewall updates the given firewalls instead of ones built for the
+// configured backend. fw6 may be nil to disable IPv6 filtering.
+func WithFirewall(fw, fw6 firewall.Firewall) Option {
+	return func(r *Reconciler) { r.fw, r.fw6 = fw, fw6 }
+}
+
+// WithDryRun prints the firewall commands to w instead of running them
+func WithDryRun(w io.Writer) Option {
+	return func(r *Reconciler) { r.dryRun = w }
+}
+
+// WithLogger logs to the given logger instead of the default one
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Reconciler) { r.logger = logger }
+}
+
+// WithForce applies peer lists which are empty or shrink by more than the
+// configured percentage
+func WithForce(force bool) Option {
+	return func(r *Reconciler) { r.force = force }
+}
+
+// WithJitter delays each run by up to the given fraction of the interval in
+// Run
+func WithJitter(jitter float64) Option {
+	return func(r *Reconciler) { r.jitter = jitter }
+}
+
+// New returns a Reconciler for the validated config
+func New(cfg Config, opts ...Option) (*Reconciler, error) {
+	r := &Reconciler{
+		cfg:     cfg,
+		metrics: NewMetrics(),
+		logger:  slog.Default(),
+		jitter:  0.1,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.allBackends = r.fw == nil && r.cfg.Backend == "auto"
+
+	// policies and allowed networks are only supported by the iptables backend
+	if r.cfg.Backend == "auto" && r.cfg.needsIPTables() != "" {
+		r.cfg.Backend = "iptables"
+		if r.fw == nil {
+			r.replaced, _ = firewall.New("nftables", false, r.dryRun)
+		}
+	}
+
+	if r.fw == nil {
+		var err error
+		r.fw, err = firewall.New(r.cfg.Backend, false, r.dryRun)
+		if err != nil {
+			return nil, err
+		}
+
+		// droplets with ipv6 enabled have their public interface filtered
+		// with ip6tables as well
+		r.fw6, err = firewall.New(r.cfg.Backend, true, r.dryRun)
+		if err != nil && r.cfg.Public {
+			r.logger.Warn("IPv6 filtering disabled", "err", err)
+		}
+	}
+
+	// each metadata lookup and API request is limited to the operation
+	// timeout
+	if r.meta == nil {
+		r.meta = metadata.NewClient(metadata.WithHTTPClient(&http.Client{Timeout: r.cfg.OperationTimeout.Duration}))
+	}
+
+	client := r.client
+	if client == nil {
+		oauthClient := oauth2.NewClient(oauth2.NoContext, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: r.cfg.Token}))
+		oauthClient.Timeout = r.cfg.OperationTimeout.Duration
+		client = godo.NewClient(oauthClient)
+	}
+	r.useAPI(client)
+	r.client = nil
+	return r, nil
+}
+
+// checkSwitch returns an error when the auto backend has to use iptables, but
+// the chains (or sets) are installed with the replaced backend. Its rules would
+// keep filtering the interfaces, dropping the peers only iptables allows.
+func (r *Reconciler) checkSwitch(ctx context.Context, replaced firewall.Firewall) error {
+	for _, chain := range []string{r.cfg.Chains.Private, r.cfg.Chains.Public} {
+		err := r.withTimeout(ctx, func(ctx context.Context) error {
+			return replaced.Check(ctx, chain)
+		})
+		if err == nil {
+			return &ConfigError{Key: r.cfg.needsIPTables(), Err: fmt.Errorf("needs the iptables backend, but %s is installed with nftables, run droplan uninstall first", chain)}
+		}
+	}
+	return nil
+}
+
+// useAPI lists droplets, VPCs and floating IPs with the godo client, recording
+// each request in the metrics and retrying failed requests within the retry
+// budget
+func (r *Reconciler) useAPI(client *godo.Client) {
+	budget := r.cfg.APIRetryBudget.Duration
+	// droplets are listed with their VPCs, so peers in the local droplet's VPC
+	// are found without listing the VPC's members
+	droplets := discovery.NewVPCDroplets(client)
+	r.droplets = discovery.RetryDroplets(&meteredDroplets{DropletsService: droplets, metrics: r.metrics}, budget, r.logger)
+	r.vpcs = discovery.RetryVPCs(&meteredVPCs{VPCService: droplets, metrics: r.metrics}, budget, r.logger)
+	r.floatingIPs = discovery.RetryFloatingIPs(&meteredFloatingIPs{FloatingIPsService: client.FloatingIPs, metrics: r.metrics}, budget, r.logger)
+}
+
+// Metrics returns the metrics recorded by Run, served on /metrics in daemon
+// mode
+func (r *Reconciler) Metrics() *Metrics {
+	return r.metrics
+}
+
+// Run reconciles every configured interval until the context is done. Errors
+// are logged and retried rather than returned.
+func (r *Reconciler) Run(ctx context.Context) {
+	reconcile := func() error {
+		return r.Reconcile(ctx)
+	}
+	dmn := newDaemon(r.metrics.Sync(reconcile), r.cfg.Interval.Duration, r.jitter)
+	dmn.logger = r.logger
+	dmn.Run(ctx.Done())
+}
+
+// Reconcile performs a single pass of collecting peers and updating the
+// iptables chains to match. The pass is abandoned once the context is done or
+// the configured timeout has passed.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout.Duration)
+	defer cancel()
+
+	err := r.reconcile(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("reconcile did not finish within %s: %w", r.cfg.Timeout, err)
+	}
+	return err
+}
+
+// reconcile performs a single pass of Reconcile
+func (r *Reconciler) reconcile(ctx context.Context) error {
+	if r.replaced != nil {
+		err := r.checkSwitch(ctx, r.replaced)
+		if err != nil {
+			return err
+		}
+	}
+
+	// collect needed metadata from metadata service
+	region, err := discovery.DropletRegion(ctx, r.meta)
+	if err != nil {
+		return err
+	}
+	mData, err := discovery.DropletMetadata(ctx, r.meta)
+	if err != nil {
+		return err
+	}
+
+	logger := r.logger.With("region", region)
+	if len(r.cfg.Tags) > 0 {
+		logger = logger.With("tags", r.cfg.Tags, "tag_mode", r.cfg.TagMode)
+	}
+
+	// collect list of all droplets
+	var drops []godo.Droplet
+	if len(r.cfg.Tags) > 0 {
+		drops, err = discovery.DropletListTagSet(ctx, r.droplets, r.cfg.Tags, r.cfg.TagMode)
+	} else {
+		drops, err = discovery.DropletList(ctx, r.droplets)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Debug("Listed droplets", "droplets", len(drops))
+
+	// the droplet's own addresses are always allowed, even when it is not
+	// listed itself
+	local, local6 := discovery.LocalAddresses(mData, false), discovery.LocalAddresses(mData, true)
+	logger.Info("Allowing local addresses", "local_peers", append(append([]string{}, local...), local6...))
+
+	// collect local network interface information
+	ifaces, err := discovery.LocalInterfaces()
+	if err != nil {
+		return err
+	}
+
+	pubAddr, err := discovery.PublicAddress(mData)
+	if err != nil {
+		return err
+	}
+
+	if r.cfg.Public {
+		// peers may also send traffic from their floating IPs
+		floatingIPs, err := discovery.FloatingIPList(ctx, r.floatingIPs)
+		if err != nil {
+			return err
+		}
+		discovered := discovery.MergePeers(discovery.PublicDroplets(drops), discovery.PublicFloatingIPs(drops, floatingIPs))
+		publicPeers := discovery.MergePeers(discovered, discovery.StaticPeers(r.cfg.Allow.Public, false))
+
+		// find public iface name
+		iface, err := r.findInterface(ifaces, "public", r.cfg.Interfaces.Public, discovery.PublicMAC(mData), pubAddr)
+		if err != nil {
+			return err
+		}
+
+		// setup and update droplan-peers-public for public interface
+		err = r.apply(ctx, logger, r.fw, iface, publicPeers, local, r.cfg.Chains.Public)
+		if err != nil {
+			return err
+		}
+
+		pubAddr6, err := discovery.PublicAddressV6(mData)
+		if err == nil && r.fw6 != nil {
+			publicPeers6 := discovery.MergePeers(discovery.PublicDropletsV6(drops), discovery.StaticPeers(r.cfg.Allow.Public, true))
+
+			// find public iface name, falling back to its ipv6 address
+			iface, err := r.findInterface(ifaces, "public", r.cfg.Interfaces.Public, discovery.PublicMAC(mData), pubAddr6)
+			if err != nil {
+				return err
+			}
+
+			// setup and update the ipv6 droplan-peers-public
+			err = r.apply(ctx, logger, r.fw6, iface, publicPeers6, local6, r.cfg.Chains.Public)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	privAddr, err := discovery.PrivateAddress(mData)
+	if r.cfg.Public && errors.Is(err, discovery.ErrNoPrivateInterface) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	privatePeers, err := r.privatePeers(ctx, logger, mData.DropletID, region, drops)
+	if err != nil {
+		return err
+	}
+
+	// find private iface name
+	iface, err := r.findInterface(ifaces, "private", r.cfg.Interfaces.Private, discovery.PrivateMAC(mData), privAddr)
+	if err != nil {
+		return err
+	}
+
+	// setup and update droplan-peers for private interface
+	allowed := discovery.StaticPeers(r.cfg.Allow.Private, false)
+	if len(r.cfg.Policies) > 0 {
+		return r.applyPolicies(ctx, logger, iface, privatePeers, allowed, local, r.cfg.Chains.Private)
+	}
+	return r.apply(ctx, logger, r.fw, iface, discovery.MergePeers(discovery.Addresses(privatePeers), allowed), local, r.cfg.Chains.Private)
+}
+
+// privatePeers returns the private peers among the droplets, which are those
+// in the local droplet's VPC. Droplets not in a VPC, or configured to group by
+// region, select the droplets in their region instead.
+func (r *Reconciler) privatePeers(ctx context.Context, logger *slog.Logger, dropletID int, region string, drops []godo.Droplet) ([]discovery.Peer, error) {
+	if r.cfg.Grouping == discovery.GroupingVPC {
+		vpcs := r.vpcs.ListedVPCs()
+		vpc, ok := vpcs[dropletID]
+		if !ok {
+			// the local droplet is not listed when it does not have the tags
+			var err error
+			vpc, err = discovery.DropletVPCUUID(ctx, r.vpcs, dropletID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if vpc != "" {
+			peers := discovery.VPCPeers(drops, vpcs, vpc)
+			if len(peers) == 0 {
+				logger.Warn("No droplets listed in VPC", "vpc", vpc)
+			}
+			return peers, nil
+		}
+		logger.Warn("Droplet is not in a VPC, selecting peers by region")
+	}
+
+	peers, ok := discovery.SortDroplets(drops)[region]
+	if !ok {
+		logger.Warn("No droplets listed in region")
+	}
+	return peers, nil
+}
+
+// findInterface returns the configured interface name, or looks up the name
+// of the interface with the MAC or local address from metadata when none is
+// configured
+func (r *Reconciler) findInterface(ifaces []discovery.Interface, kind, configured, mac, local string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	iface, err := discovery.FindInterface(ifaces, mac, local)
+	if err != nil {
+		return "", fmt.Errorf("%s interface: %w", kind, err)
+	}
+	return iface, nil
+}
+
+// apply sets up the named chain (or set) of the firewall on the interface and
+// updates it to hold the given peers and local addresses
+func (r *Reconciler) apply(ctx context.Context, logger *slog.Logger, fw firewall.Firewall, iface string, peers, local []string, chain string) error {
+	family := "ipv4"
+	if fw == r.fw6 {
+		family = "ipv6"
+	}
+	logger = logger.With("chain", chain, "interface", iface, "family", family)
+
+	err := r.guard(ctx, logger, fw, chain, peers, local)
+	if err != nil {
+		return err
+	}
+
+	err = r.withTimeout(ctx, func(ctx context.Context) error {
+		return fw.Setup(ctx, iface, chain)
+	})
+	if err != nil {
+		r.metrics.FirewallFailed()
+		return err
+	}
+
+	var changes firewall.PeerChanges
+	err = r.withTimeout(ctx, func(ctx context.Context) (err error) {
+		changes, err = fw.UpdatePeers(ctx, discovery.MergePeers(peers, local), chain)
+		return err
+	})
+	if err != nil {
+		r.metrics.FirewallFailed()
+		return err
+	}
+
+	r.metrics.SetPeers(chain, family, len(changes.Added)+changes.Unchanged)
+	logChanges(logger, changes)
+	return nil
+}
+
+// applyPolicies sets up the named chain of the firewall on the interface and
+// updates it to allow peers only the ports their policies allow, and the
+// static allowed peers and local addresses every port
+func (r *Reconciler) applyPolicies(ctx context.Context, logger *slog.Logger, iface string, peers []discovery.Peer, allowed, local []string, chain string) error {
+	fw, ok := r.fw.(firewall.PolicyFirewall)
+	if !ok {
+		return fmt.Errorf("policies are not supported by the %s backend", r.cfg.Backend)
+	}
+	logger = logger.With("chain", chain, "interface", iface, "family", "ipv4", "policies", len(r.cfg.Policies))
+
+	err := r.guard(ctx, logger, r.fw, chain, discovery.MergePeers(firewall.PolicyPeers(peers, r.cfg.Policies), allowed), local)
+	if err != nil {
+		return err
+	}
+
+	err = r.withTimeout(ctx, func(ctx context.Context) error {
+		return r.fw.Setup(ctx, iface, chain)
+	})
+	if err != nil {
+		r.metrics.FirewallFailed()
+		return err
+	}
+
+	var changes firewall.PeerChanges
+	err = r.withTimeout(ctx, func(ctx context.Context) (err error) {
+		changes, err = fw.UpdatePolicies(ctx, peers, discovery.MergePeers(allowed, local), r.cfg.Policies, chain)
+		return err
+	})
+	if err != nil {
+		r.metrics.FirewallFailed()
+		return err
+	}
+
+	r.metrics.SetPeers(chain, "ipv4", len(changes.Added)+changes.Unchanged)
+	logChanges(logger, changes)
+	return nil
+}
+
+// guard refuses to set up or update the chain (or set) with peers which are
+// empty or would shrink it by more than the configured percentage, unless
+// forced. The local addresses are always kept so they are not counted. It runs
+// before the chain is set up, so one which does not exist yet has no peers.
+func (r *Reconciler) guard(ctx context.Context, logger *slog.Logger, fw firewall.Firewall, chain string, peers, local []string) error {
+	if r.force {
+		return nil
+	}
+
+	current := []string{}
+	err := r.withTimeout(ctx, func(ctx context.Context) (err error) {
+		if fw.Check(ctx, chain) != nil {
+			return nil
+		}
+		current, err = fw.Peers(ctx, chain)
+		return err
+	})
+	if err != nil {
+		r.metrics.FirewallFailed()
+		return err
+	}
+	current, peers = withoutPeers(current, local), withoutPeers(peers, local)
+
+	err = CheckPeers(chain, current, peers, r.cfg.MaxShrink)
+	if err != nil {
+		logger.Error("Refusing to update peers, discovery may have failed",
+			"current", countUnique(current),
+			"desired", countUnique(peers),
+			"max_shrink", r.cfg.MaxShrink,
+			"err", err,
+		)
+	}
+	return err
+}
+
+// Uninstall removes the rules and chains (or sets) droplan added to the private
+// and public interfaces. Interfaces which were never set up are skipped, so it
+// is safe to run repeatedly. With the auto backend, the rules of every
+// installed backend are removed.
+func (r *Reconciler) Uninstall(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout.Duration)
+	defer cancel()
+
+	mData, err := discovery.DropletMetadata(ctx, r.meta)
+	if err != nil {
+		return err
+	}
+
+	ifaces, err := discovery.LocalInterfaces()
+	if err != nil {
+		return err
+	}
+
+	type target struct {
+		fw         firewall.Firewall
+		kind       string
+		addr       func(*metadata.Metadata) (string, error)
+		mac        func(*metadata.Metadata) string
+		configured string
+		chain      string
+	}
+	fws, fws6 := []firewall.Firewall{r.fw}, []firewall.Firewall{r.fw6}
+	if r.allBackends {
+		fws, fws6 = firewall.NewAll(false, r.dryRun), firewall.NewAll(true, r.dryRun)
+	}
+
+	targets := []target{}
+	for _, fw := range fws {
+		targets = append(targets,
+			target{fw, "private", discovery.PrivateAddress, discovery.PrivateMAC, r.cfg.Interfaces.Private, r.cfg.Chains.Private},
+			target{fw, "public", discovery.PublicAddress, discovery.PublicMAC, r.cfg.Interfaces.Public, r.cfg.Chains.Public},
+		)
+	}
+	for _, fw6 := range fws6 {
+		if fw6 != nil {
+			targets = append(targets, target{fw6, "public", discovery.PublicAddressV6, discovery.PublicMAC, r.cfg.Interfaces.Public, r.cfg.Chains.Public})
+		}
+	}
+
+	for _, t := range targets {
+		addr, err := t.addr(mData)
+		if err != nil {
+			// the droplet does not have this interface
+			continue
+		}
+
+		iface, err := r.findInterface(ifaces, t.kind, t.configured, t.mac(mData), addr)
+		if err != nil {
+			return err
+		}
+
+		err = r.withTimeout(ctx, func(ctx context.Context) error {
+			return t.fw.Teardown(ctx, iface, t.chain)
+		})
+		if err != nil {
+			return err
+		}
+		r.logger.Info("Removed chain", "chain", t.chain, "interface", iface)
+	}
+	return nil
+}
+
+// withTimeout calls f with a context which is done once the operation timeout
+// has passed, or when ctx is done
+func (r *Reconciler) withTimeout(ctx context.Context, f func(context.Context) error) error {
+	opCtx, cancel := context.WithTimeout(ctx, r.cfg.OperationTimeout.Duration)
+	defer cancel()
+
+	err := f(opCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(opCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("firewall operation did not finish within %s: %w", r.cfg.OperationTimeout, err)
+	}
+	return err
+}
+
+// logChanges logs a summary of the peers updated in the given chain
+func logChanges(logger *slog.Logger, changes firewall.PeerChanges) {
+	logger.Info("Updated peers",
+		"added", len(changes.Added),
+		"removed", len(changes.Removed),
+		"unchanged", changes.Unchanged,
+		"added_peers", changes.Added,
+		"removed_peers", changes.Removed,
+	)
+}
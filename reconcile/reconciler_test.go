@@ -0,0 +1,232 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/tam7t/droplan/discovery"
+	"github.com/tam7t/droplan/firewall"
+)
+
+func TestReconcilerPrivatePeers(t *testing.T) {
+	drops := []godo.Droplet{
+		{ID: 1, Region: &godo.Region{Slug: "nyc3"}, Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: "10.0.0.1", Type: "private"}}}},
+		{ID: 2, Region: &godo.Region{Slug: "nyc3"}, Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: "10.0.0.2", Type: "private"}}}},
+		{ID: 3, Region: &godo.Region{Slug: "sfo2"}, Networks: &godo.Networks{V4: []godo.NetworkV4{{IPAddress: "10.0.0.3", Type: "private"}}}},
+	}
+
+	tests := []struct {
+		name     string
+		grouping string
+		listed   map[int]string
+		vpc      string
+		exp      []discovery.Peer
+	}{
+		{
+			name:     "droplets in the same vpc",
+			grouping: discovery.GroupingVPC,
+			listed:   map[int]string{1: "vpc-1", 2: "vpc-2", 3: ""},
+			exp:      []discovery.Peer{{Address: "10.0.0.1"}},
+		},
+		{
+			name:     "vpc of a droplet which is not listed is looked up",
+			grouping: discovery.GroupingVPC,
+			listed:   map[int]string{2: "vpc-1", 3: "vpc-2"},
+			vpc:      "vpc-1",
+			exp:      []discovery.Peer{{Address: "10.0.0.2"}},
+		},
+		{
+			name:     "droplet not in a vpc falls back to region",
+			grouping: discovery.GroupingVPC,
+			listed:   map[int]string{1: "", 2: "vpc-1"},
+			exp:      []discovery.Peer{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}},
+		},
+		{
+			name:     "grouping by region",
+			grouping: discovery.GroupingRegion,
+			listed:   map[int]string{1: "vpc-1", 2: "vpc-2"},
+			exp:      []discovery.Peer{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}},
+		},
+	}
+
+	for _, test := range tests {
+		r := &Reconciler{
+			cfg: Config{Grouping: test.grouping},
+			vpcs: &stubVPCService{
+				dropletVPC: func(id int) (string, *godo.Response, error) {
+					if _, ok := test.listed[id]; ok {
+						t.Fatalf("test case failed: %s: listed droplet looked up", test.name)
+					}
+					return test.vpc, &godo.Response{}, nil
+				},
+				listedVPCs: func() map[int]string { return test.listed },
+			},
+		}
+
+		peers, err := r.privatePeers(context.Background(), slog.Default(), 1, "nyc3", drops)
+		if err != nil || !reflect.DeepEqual(peers, test.exp) {
+			t.Logf("want:%v", test.exp)
+			t.Logf("got:%v %v", peers, err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestReconcilerWithTimeout(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		f      func(context.Context) error
+		expErr string
+	}{
+		{
+			name: "operation finishes",
+			ctx:  context.Background(),
+			f:    func(context.Context) error { return nil },
+		},
+		{
+			name: "operation times out",
+			ctx:  context.Background(),
+			f: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			expErr: "firewall operation did not finish within 1ms: context deadline exceeded",
+		},
+		{
+			name: "run is abandoned",
+			ctx:  canceled,
+			f: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			expErr: "context canceled",
+		},
+	}
+
+	for _, test := range tests {
+		r := &Reconciler{cfg: Config{OperationTimeout: Duration{time.Millisecond}}}
+		err := r.withTimeout(test.ctx, test.f)
+		if (err == nil && test.expErr != "") || (err != nil && err.Error() != test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestReconcilerCheckSwitch(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed []string
+		expErr    string
+	}{
+		{
+			name:      "nothing installed",
+			installed: []string{},
+		},
+		{
+			name:      "public chain installed",
+			installed: []string{"droplan-peers-public"},
+			expErr:    "policies: needs the iptables backend, but droplan-peers-public is installed with nftables, run droplan uninstall first",
+		},
+	}
+
+	for _, test := range tests {
+		fw := &stubFirewall{
+			check: func(chain string) error {
+				for _, installed := range test.installed {
+					if chain == installed {
+						return nil
+					}
+				}
+				return errors.New("does not exist")
+			},
+		}
+		cfg := DefaultConfig()
+		cfg.Policies = []firewall.Policy{{Tag: "web", Ports: []string{"tcp/80"}}}
+		r := &Reconciler{cfg: cfg}
+
+		err := r.checkSwitch(context.Background(), fw)
+		if (err == nil && test.expErr != "") || (err != nil && err.Error() != test.expErr) {
+			t.Logf("want:%v", test.expErr)
+			t.Logf("got:%v", err)
+			t.Fatalf("test case failed: %s", test.name)
+		}
+	}
+}
+
+func TestLogChanges(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{ReplaceAttr: dropTime}))
+
+	logChanges(logger.With("chain", "droplan-peers"), firewall.PeerChanges{Added: []string{"10.0.0.2"}, Removed: []string{}, Unchanged: 1})
+
+	exp := `{"level":"INFO","msg":"Updated peers","chain":"droplan-peers","added":1,"removed":0,"unchanged":1,"added_peers":["10.0.0.2"],"removed_peers":[]}` + "\n"
+	if out.String() != exp {
+		t.Logf("want:%v", exp)
+		t.Logf("got:%v", out.String())
+		t.Fatal("unexpected log output")
+	}
+}
+
+type stubVPCService struct {
+	dropletVPC func(int) (string, *godo.Response, error)
+	listedVPCs func() map[int]string
+}
+
+func (s *stubVPCService) DropletVPC(ctx context.Context, dropletID int) (string, *godo.Response, error) {
+	return s.dropletVPC(dropletID)
+}
+
+func (s *stubVPCService) ListedVPCs() map[int]string {
+	return s.listedVPCs()
+}
+
+type stubFirewall struct {
+	setup       func(string, string) error
+	updatePeers func([]string, string) (firewall.PeerChanges, error)
+	teardown    func(string, string) error
+	check       func(string) error
+	peers       func(string) ([]string, error)
+}
+
+func (sfw *stubFirewall) Setup(ctx context.Context, a, b string) error {
+	return sfw.setup(a, b)
+}
+
+func (sfw *stubFirewall) UpdatePeers(ctx context.Context, a []string, b string) (firewall.PeerChanges, error) {
+	return sfw.updatePeers(a, b)
+}
+
+func (sfw *stubFirewall) Teardown(ctx context.Context, a, b string) error {
+	return sfw.teardown(a, b)
+}
+
+func (sfw *stubFirewall) Check(ctx context.Context, a string) error {
+	if sfw.check == nil {
+		return nil
+	}
+	return sfw.check(a)
+}
+
+func (sfw *stubFirewall) Peers(ctx context.Context, a string) ([]string, error) {
+	return sfw.peers(a)
+}
+
+// dropTime removes the time from log records
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey && len(groups) == 0 {
+		return slog.Attr{}
+	}
+	return a
+}